@@ -1,3 +1,3 @@
 module github.com/Thomas-Redding/util/tree/main/go
 
-go 1.17
+go 1.18
@@ -1,12 +1,46 @@
 package main
 
 import (
+  "archive/tar"
+  "archive/zip"
+  "bufio"
+  "bytes"
+  "compress/flate"
+  "compress/gzip"
+  "context"
+  "crypto/md5"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/sha512"
+  "encoding/binary"
+  "encoding/csv"
+  "encoding/hex"
+  "encoding/json"
   "errors"
   "fmt"
+  "hash"
+  "hash/crc32"
+  "image"
+  "image/color"
+  _ "image/gif"
+  "image/jpeg"
+  "image/png"
   "io"
+  "io/ioutil"
+  "math"
+  "math/bits"
+  "mime"
   "net/http"
   "os"
+  "path"
+  "path/filepath"
+  "sort"
   "strings"
+  "sync"
+  "time"
+  "unicode"
+  "unicode/utf16"
+  "unicode/utf8"
 )
 
 /*
@@ -15,7 +49,7 @@ import (
  * @returns a list of children or an error 
  */
 func ChildrenOfDir(dirPath string) ([]string, error) {
-  files, err := ioutil.ReadDir(path)
+  files, err := ioutil.ReadDir(dirPath)
   if err != nil { return nil, err }
   rtn := []string{}
   for _, file := range files {
@@ -24,7 +58,210 @@ func ChildrenOfDir(dirPath string) ([]string, error) {
   return rtn, nil
 }
 
+/*
+ * Returns all the descendants of a directory, skipping those matched by gitignore-style patterns.
+ * @param dirPath the path to the directory
+ * @param patterns the patterns to exclude, in .gitignore syntax
+ * @returns the paths (relative to dirPath) of every non-ignored file and directory, or an error
+ *
+ * Supported syntax:
+ *   foo        matches a file or directory named "foo" at any depth
+ *   /foo       matches "foo" only directly inside dirPath
+ *   foo/bar    patterns containing a slash are relative to dirPath
+ *   foo/       matches directories only
+ *   *, ?, [a-z] match within a single path segment
+ *   foo/**     matches everything inside "foo"
+ * A "**" segment at the start or in the middle of a pattern matches zero or more
+ * directories, so "a", "**", "b" joined by slashes matches "a/b", "a/x/b", "a/x/y/b", ...
+ * A pattern starting with "!" re-includes paths an earlier pattern ignored; as in
+ * git, the last pattern that matches a path decides. Blank lines and lines
+ * starting with "#" are ignored, and "\!" or "\#" match a literal leading "!" or "#".
+ * The contents of an ignored directory are never visited, so (again as in git)
+ * "!" can't re-include a file whose directory is ignored.
+ */
+func ChildrenOfDirIgnoring(dirPath string, patterns []string) ([]string, error) {
+  matcher := newIgnoreMatcher(patterns)
+  rtn := []string{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil {
+      return err
+    }
+    if relPath == "." {
+      return nil
+    }
+    if matcher.match(filepath.ToSlash(relPath), info.IsDir()) {
+      if info.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    rtn = append(rtn, relPath)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return rtn, nil
+}
+
+type ignorePattern struct {
+  segments []string
+  dirOnly bool
+  negate bool
+}
+
+type ignoreMatcher []ignorePattern
+
+func newIgnoreMatcher(patterns []string) ignoreMatcher {
+  matcher := ignoreMatcher{}
+  for _, pattern := range patterns {
+    pattern = strings.TrimRight(pattern, " ")
+    if pattern == "" || strings.HasPrefix(pattern, "#") {
+      continue
+    }
+    ignore := ignorePattern{}
+    if strings.HasPrefix(pattern, "!") {
+      ignore.negate = true
+      pattern = pattern[1:]
+    }
+    if strings.HasSuffix(pattern, "/") {
+      ignore.dirOnly = true
+      pattern = strings.TrimRight(pattern, "/")
+    }
+    if pattern == "" {
+      continue
+    }
+    // A pattern with no inner slash may match at any depth.
+    if !strings.Contains(pattern, "/") {
+      pattern = "**/" + pattern
+    }
+    pattern = strings.TrimPrefix(pattern, "/")
+    ignore.segments = strings.Split(pattern, "/")
+    matcher = append(matcher, ignore)
+  }
+  return matcher
+}
+
+// Reports whether the slash-separated relative path is ignored.
+func (matcher ignoreMatcher) match(relPath string, isDir bool) bool {
+  segments := strings.Split(relPath, "/")
+  ignored := false
+  for _, ignore := range matcher {
+    if ignore.dirOnly && !isDir {
+      continue
+    }
+    if matchSegments(ignore.segments, segments) {
+      ignored = !ignore.negate
+    }
+  }
+  return ignored
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+  if len(pattern) == 0 {
+    return len(segments) == 0
+  }
+  if pattern[0] == "**" {
+    // A trailing "**" matches everything inside, but not the directory itself.
+    if len(pattern) == 1 {
+      return len(segments) > 0
+    }
+    for i := 0; i <= len(segments); i++ {
+      if matchSegments(pattern[1:], segments[i:]) {
+        return true
+      }
+    }
+    return false
+  }
+  if len(segments) == 0 {
+    return false
+  }
+  matched, err := path.Match(pattern[0], segments[0])
+  if err != nil || !matched {
+    return false
+  }
+  return matchSegments(pattern[1:], segments[1:])
+}
+
 func CopyFile(inPath string, outPath string) error {
+  return CopyFileWithOptions(inPath, outPath, CopyFileOptions{})
+}
+
+/*
+ * Options for CopyFileWithOptions(). The zero value behaves like CopyFile().
+ */
+type CopyFileOptions struct {
+  // Linux only: read and write with O_DIRECT, bypassing the page cache, so copying
+  // a huge file doesn't evict other programs' cached data. The data is moved in
+  // 1 MB buffers aligned to 4096 bytes (which satisfies the alignment rules of
+  // common filesystems); the final partial block is written without O_DIRECT.
+  // If the filesystem doesn't support O_DIRECT (e.g. tmpfs), or on other
+  // platforms, this falls back to a normal copy.
+  DirectIO bool
+  // When to fsync the copy. The default, NoSync, is fastest but leaves the data to
+  // the OS, so a crash or power cut soon after may lose or truncate the copy.
+  SyncMode SyncMode
+  // For SyncEveryNBytes, how much to write between fsyncs. Defaults to 8 MB.
+  SyncEveryBytes int64
+  // Once copied, mark the copy immutable with SetFileImmutable() (Linux only, and
+  // needs CAP_LINUX_IMMUTABLE). Copying over an immutable file fails, so clear the
+  // flag on the old copy first when redeploying.
+  Immutable bool
+  // The buffer to copy through. Defaults to OptimalCopyBuffer() of the file's size.
+  // Only used when the OS can't copy file-to-file itself, and not with SyncEveryNBytes.
+  BufferSize int
+}
+
+/*
+ * How CopyFileWithOptions() flushes a copy to disk.
+ */
+type SyncMode int
+
+const (
+  // Never fsync; the copy is durable whenever the OS gets around to it (usually within seconds).
+  NoSync SyncMode = iota
+  // Fsync once the copy is written, so it's durable when the copy returns.
+  // Recommended for data that matters; the cost is one disk flush per file.
+  SyncOnClose
+  // Fsync every SyncEveryBytes while copying, and at the end. This is as durable
+  // as SyncOnClose, and keeps a huge copy from piling up gigabytes of dirty pages
+  // (which can stall other writers when the OS flushes them all at once), at the
+  // cost of throughput.
+  SyncEveryNBytes
+)
+
+/*
+ * Copy a file.
+ * @param inPath the file to copy
+ * @param outPath where to write the copy
+ * @param options how to copy
+ * @returns an error
+ */
+func CopyFileWithOptions(inPath string, outPath string, options CopyFileOptions) error {
+  if options.Immutable {
+    options.Immutable = false
+    err := CopyFileWithOptions(inPath, outPath, options)
+    if err != nil {
+      return err
+    }
+    return SetFileImmutable(outPath, true)
+  }
+  release, _ := acquireIO(context.Background())
+  defer release()
+  if options.DirectIO {
+    handled, err := copyFileDirect(inPath, outPath)
+    if handled {
+      if err != nil || options.SyncMode == NoSync {
+        return err
+      }
+      // O_DIRECT skips the page cache, but not the drive's cache or the metadata.
+      return syncFile(outPath)
+    }
+  }
   // https://opensource.com/article/18/6/copying-files-go
   inFile, err := os.Open(inPath)
   if err != nil { return err }
@@ -32,278 +269,5661 @@ func CopyFile(inPath string, outPath string) error {
   outFile, err := os.Create(outPath)
   if err != nil { return err }
   defer outFile.Close()
-  _, err = io.Copy(outFile, inFile)
-  return err
+  if options.SyncMode == SyncEveryNBytes {
+    chunk := options.SyncEveryBytes
+    if chunk <= 0 {
+      chunk = 8 << 20
+    }
+    for {
+      n, err := io.CopyN(outFile, inFile, chunk)
+      if err != nil && err != io.EOF {
+        return wrapDiskFull(outPath, err)
+      }
+      if n > 0 {
+        err := outFile.Sync()
+        if err != nil {
+          return wrapDiskFull(outPath, err)
+        }
+      }
+      if n < chunk {
+        break
+      }
+    }
+  } else {
+    size := int64(0)
+    if info, err := inFile.Stat(); err == nil {
+      size = info.Size()
+    }
+    bufferSize := options.BufferSize
+    if bufferSize <= 0 {
+      bufferSize = OptimalCopyBuffer(size)
+    }
+    _, err = io.CopyBuffer(outFile, inFile, make([]byte, bufferSize))
+    if err != nil {
+      return wrapDiskFull(outPath, err)
+    }
+  }
+  if options.SyncMode != NoSync {
+    err = outFile.Sync()
+    if err == nil {
+      err = outFile.Close()
+    }
+  }
+  return wrapDiskFull(outPath, err)
 }
 
-func CopyDir(fromPath string, toPath string) error {
-  // https://stackoverflow.com/a/67980768/4004969
-  if toPath[:len(fromPath)] == fromPath {
-    return errors.New("Cannot copy a folder into the folder itself!")
+/*
+ * Pick a buffer size for copying a file of the given size.
+ * @param fileSize the size of the file in bytes, or 0 if unknown
+ * @returns the buffer size in bytes
+ *
+ * Files up to 256 KB get a buffer just big enough to read them in one go (at
+ * least 4 KB), so copying many small files doesn't allocate much. Larger files
+ * get about 1/64th of their size, between 256 KB and a cap of 4 MB. An unknown
+ * size gets io.Copy()'s default of 32 KB. BenchmarkOptimalCopyBuffer measures
+ * these choices: a buffer much bigger than a small file mostly costs its
+ * allocation (a 1 MB buffer copies a 16 KB file at about half the speed), and
+ * past a few hundred KB per syscall throughput stops improving, so the 4 MB
+ * cap is there to bound memory rather than for speed.
+ * CopyFile() uses this, though where the OS can copy file-to-file directly
+ * (copy_file_range on Linux) the buffer isn't needed at all.
+ */
+func OptimalCopyBuffer(fileSize int64) int {
+  const minBuffer, smallFile, maxBuffer = 4 << 10, 256 << 10, 4 << 20
+  if fileSize <= 0 {
+    return 32 << 10
   }
+  if fileSize <= smallFile {
+    size := minBuffer
+    for int64(size) < fileSize {
+      size *= 2
+    }
+    return size
+  }
+  size := int64(smallFile)
+  for size < fileSize / 64 && size < maxBuffer {
+    size *= 2
+  }
+  return int(size)
+}
 
-  f, err := os.Open(fromPath)
+// Fsyncs a file that has already been written and closed.
+func syncFile(filePath string) error {
+  file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
   if err != nil {
     return err
   }
+  err = file.Sync()
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  return wrapDiskFull(filePath, err)
+}
 
-  file, err := f.Stat()
+var ErrIOTimeout = errors.New("File operation timed out")
+
+/*
+ * Copy a file, giving up if any single read or write takes too long.
+ * @param inPath the file to copy
+ * @param outPath where to write the copy
+ * @param perOpTimeout the longest one read or write (of up to 1 MB) may take
+ * @returns ErrIOTimeout if an operation stalled, or another error
+ *
+ * This is meant for network filesystems that can hang mid-copy: a copy that is
+ * slow but steady never times out, while one stuck syscall does. On any error
+ * the partial copy is removed. Regular files can't have deadlines, so a stalled
+ * operation is abandoned in a goroutine rather than cancelled; it (and its file)
+ * stays around until the filesystem finally answers.
+ */
+func CopyFileWithIOTimeout(inPath string, outPath string, perOpTimeout time.Duration) error {
+  inFile, err := os.Open(inPath)
+  if err != nil {
+    return err
+  }
+  outFile, err := os.Create(outPath)
+  if err != nil {
+    inFile.Close()
+    return err
+  }
+  err = copyWithIOTimeout(outFile, inFile, perOpTimeout)
+  if err == ErrIOTimeout {
+    // Closing a file with a stuck operation could hang too.
+    go inFile.Close()
+    go outFile.Close()
+    os.Remove(outPath)
+    return err
+  }
+  inFile.Close()
+  if closeErr := outFile.Close(); err == nil {
+    err = closeErr
+  }
   if err != nil {
+    os.Remove(outPath)
+  }
+  return wrapDiskFull(outPath, err)
+}
+
+func copyWithIOTimeout(w io.Writer, r io.Reader, timeout time.Duration) error {
+  buffer := make([]byte, 1 << 20)
+  for {
+    var n int
+    err := withIOTimeout(timeout, func() error {
+      var err error
+      n, err = r.Read(buffer)
+      return err
+    })
+    if err == ErrIOTimeout {
+      return err
+    }
+    if n > 0 {
+      chunk := buffer[:n]
+      writeErr := withIOTimeout(timeout, func() error {
+        _, err := w.Write(chunk)
+        return err
+      })
+      if writeErr != nil {
+        return writeErr
+      }
+    }
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+  }
+}
+
+// Runs op, returning ErrIOTimeout if it doesn't finish in time. A timed-out op keeps running.
+func withIOTimeout(timeout time.Duration, op func() error) error {
+  done := make(chan error, 1)
+  go func() {
+    done <- op()
+  }()
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  select {
+  case err := <-done:
+    return err
+  case <-timer.C:
+    return ErrIOTimeout
+  }
+}
+
+/*
+ * Returned by ReadFileWithTimeout(). It wraps ErrIOTimeout, so errors.Is() matches either.
+ */
+var ErrReadTimeout = fmt.Errorf("%w: read", ErrIOTimeout)
+
+/*
+ * Read a whole file, giving up if it takes too long.
+ * @param filePath the file to read
+ * @param timeout how long to wait for the file to be opened and read
+ * @returns the file's contents, or ErrReadTimeout, or another error
+ *
+ * This keeps a server responsive when a network mount (e.g. NFS) stops
+ * answering and a plain ioutil.ReadFile() would block forever. There's no
+ * portable way to cancel a blocked syscall, so on a timeout the read is
+ * abandoned, not stopped: its goroutine (and open file) leaks until the
+ * filesystem answers, which on a hard-mounted share may be never. Calling this
+ * repeatedly against a dead mount leaks one goroutine per call, so back off
+ * rather than retrying in a tight loop.
+ */
+func ReadFileWithTimeout(filePath string, timeout time.Duration) ([]byte, error) {
+  var data []byte
+  err := withIOTimeout(timeout, func() error {
+    var err error
+    data, err = ioutil.ReadFile(filePath)
     return err
+  })
+  if err == ErrIOTimeout {
+    return nil, ErrReadTimeout
+  }
+  return data, err
+}
+
+/*
+ * Copy a file into a directory, keeping its name (like `cp file dir/`).
+ * @param srcPath the file to copy
+ * @param destDir the directory to copy into; it is created if needed
+ * @returns the path of the copy, or an error (including if a directory has the file's name in destDir)
+ */
+func CopyFileInto(srcPath string, destDir string) (string, error) {
+  err := os.MkdirAll(destDir, 0755)
+  if err != nil {
+    return "", err
+  }
+  destPath := filepath.Join(destDir, filepath.Base(srcPath))
+  isDir, _, err := IsDirFile(destPath)
+  if err != nil {
+    return "", err
+  }
+  if isDir {
+    return "", fmt.Errorf("%s is a directory", destPath)
+  }
+  return destPath, CopyFile(srcPath, destPath)
+}
+
+/*
+ * Copy a file, then read the copy back to check it matches.
+ * @param inPath the file to copy
+ * @param outPath where to write the copy
+ * @param hasher which hashing algorithm to use (e.g. sha256.New())
+ * @returns the hexadecimal hash of the file, or an error (including if the copy doesn't match)
+ *
+ * The source is hashed as it is copied, and the destination is hashed after it
+ * has been synced to disk. Note the re-read may be served from the OS's page
+ * cache, so this catches corruption on the way to the kernel (e.g. bad RAM)
+ * better than corruption by the storage device itself.
+ */
+func CopyFileVerified(inPath string, outPath string, hasher hash.Hash) (string, error) {
+  inFile, err := os.Open(inPath)
+  if err != nil {
+    return "", err
+  }
+  defer inFile.Close()
+  outFile, err := os.Create(outPath)
+  if err != nil {
+    return "", err
+  }
+  _, err = io.Copy(outFile, io.TeeReader(inFile, hasher))
+  if err == nil {
+    err = outFile.Sync()
+  }
+  if closeErr := outFile.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return "", wrapDiskFull(outPath, err)
+  }
+  sourceHash := hex.EncodeToString(hasher.Sum(nil))
+  hasher.Reset()
+  copyHash, err := FileHash(outPath, hasher)
+  if err != nil {
+    return "", err
+  }
+  if copyHash != sourceHash {
+    return "", fmt.Errorf("copy of %s is corrupt: expected hash %s, but %s has %s", inPath, sourceHash, outPath, copyHash)
+  }
+  return sourceHash, nil
+}
+
+/*
+ * Copy a byte range of one file into a new file.
+ * @param inPath the file to copy from
+ * @param outPath the file to create
+ * @param offset where in inPath the range starts
+ * @param length how many bytes to copy
+ * @returns an error, including if inPath is shorter than offset+length
+ *
+ * On Linux, the Go runtime performs this copy with the copy_file_range syscall
+ * (so the data never passes through user space) when the filesystem supports it,
+ * and falls back to an ordinary read/write loop otherwise.
+ */
+func CopyFileRange(inPath string, outPath string, offset int64, length int64) error {
+  inFile, err := os.Open(inPath)
+  if err != nil { return err }
+  defer inFile.Close()
+  info, err := inFile.Stat()
+  if err != nil { return err }
+  if offset < 0 || length < 0 || info.Size() < offset + length {
+    return fmt.Errorf("range %d+%d is outside %s (%d bytes)", offset, length, inPath, info.Size())
+  }
+  _, err = inFile.Seek(offset, io.SeekStart)
+  if err != nil { return err }
+  outFile, err := os.Create(outPath)
+  if err != nil { return err }
+  defer outFile.Close()
+  // *os.File.ReadFrom() recognizes a LimitedReader wrapping a file and uses copy_file_range.
+  n, err := outFile.ReadFrom(&io.LimitedReader{R: inFile, N: length})
+  if err != nil { return err }
+  if n != length {
+    return io.ErrUnexpectedEOF
+  }
+  return nil
+}
+
+func CopyDir(fromPath string, toPath string) error {
+  _, err := CopyDirWithOptions(fromPath, toPath, CopyDirOptions{})
+  return err
+}
+
+/*
+ * Statistics about a long-running operation like CopyDirWithOptions() or ZipDirWithOptions().
+ * Operations add to the counts, so one OpStats can total several operations.
+ */
+type OpStats struct {
+  BytesProcessed int64
+  FilesProcessed int
+  Elapsed time.Duration
+}
+
+/*
+ * @returns the average number of bytes processed per second
+ */
+func (stats OpStats) Throughput() float64 {
+  if stats.Elapsed <= 0 {
+    return 0
+  }
+  return float64(stats.BytesProcessed) / stats.Elapsed.Seconds()
+}
+
+/*
+ * @returns a human-readable summary like "12 files, 3.4 MB in 1.2s (2.8 MB/s)"
+ */
+func (stats OpStats) String() string {
+  files := "files"
+  if stats.FilesProcessed == 1 {
+    files = "file"
+  }
+  return fmt.Sprintf("%d %s, %s in %s (%s/s)", stats.FilesProcessed, files, formatBytes(float64(stats.BytesProcessed)), stats.Elapsed.Round(time.Millisecond), formatBytes(stats.Throughput()))
+}
+
+func formatBytes(n float64) string {
+  units := []string{"B", "KB", "MB", "GB", "TB"}
+  i := 0
+  for n >= 1000 && i < len(units) - 1 {
+    n /= 1000
+    i++
+  }
+  if i == 0 {
+    return fmt.Sprintf("%.0f %s", n, units[i])
+  }
+  return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+/*
+ * How CopyDirWithOptions() should rewrite the line endings of text files.
+ */
+type LineEndingConversion int
+
+const (
+  LineEndingNone LineEndingConversion = iota
+  LineEndingToLF
+  LineEndingToCRLF
+)
+
+/*
+ * Options for CopyDirWithOptions(). The zero value behaves like CopyDir().
+ */
+type CopyDirOptions struct {
+  // Rewrite the line endings of text files (see IsBinaryFile()) as they are copied.
+  // Binary files are always copied untouched.
+  LineEndingConversion LineEndingConversion
+  // If set, the copied files, bytes, and elapsed time are added to it.
+  Stats *OpStats
+  // Hash each file as it's copied, and hard-link files whose contents (and
+  // permissions) match an earlier copy to that copy instead of writing them again.
+  // The linked files share their data, so modifying one modifies all of them;
+  // only use this for copies that will be treated as read-only (e.g. snapshots).
+  // Where hard links aren't possible (e.g. on FAT), files are copied as usual.
+  DedupeIdentical bool
+  // If set, a line is written here for each thing the copy does, as it does it:
+  // "created dir Z", "copied X -> Y (N bytes)", or "linked X -> Y" (for
+  // DedupeIdentical). Each line is one Write() call. If the writer has a
+  // Flush() error method (like a *bufio.Writer), it's flushed when the copy
+  // finishes. Failing to write the log fails the copy.
+  OperationLog io.Writer
+}
+
+/*
+ * Copy a directory.
+ * @param fromPath the directory to copy
+ * @param toPath where to create the copy; nothing may exist here yet
+ * @param options how to copy
+ * @returns the number of files whose line endings were converted, or an error
+ */
+func CopyDirWithOptions(fromPath string, toPath string, options CopyDirOptions) (int, error) {
+  start := time.Now()
+  var copies map[string]dedupedCopy
+  if options.DedupeIdentical {
+    copies = map[string]dedupedCopy{}
+  }
+  converted, err := copyDir(fromPath, toPath, options, copies)
+  if flusher, ok := options.OperationLog.(interface{ Flush() error }); ok {
+    if flushErr := flusher.Flush(); err == nil {
+      err = flushErr
+    }
+  }
+  if options.Stats != nil {
+    options.Stats.Elapsed += time.Since(start)
+  }
+  return converted, err
+}
+
+// Writes a line to options.OperationLog, if there is one.
+func logOperation(options CopyDirOptions, format string, args ...interface{}) error {
+  if options.OperationLog == nil {
+    return nil
+  }
+  _, err := io.WriteString(options.OperationLog, fmt.Sprintf(format, args...) + "\n")
+  return err
+}
+
+// An earlier copy that DedupeIdentical can link to.
+type dedupedCopy struct {
+  path string
+  converted int
+}
+
+func copyDir(fromPath string, toPath string, options CopyDirOptions, copies map[string]dedupedCopy) (int, error) {
+  // https://stackoverflow.com/a/67980768/4004969
+  separator := string(os.PathSeparator)
+  if strings.HasPrefix(filepath.Clean(toPath) + separator, filepath.Clean(fromPath) + separator) {
+    return 0, errors.New("Cannot copy a folder into the folder itself!")
+  }
+
+  file, err := os.Stat(fromPath)
+  if err != nil {
+    return 0, err
   }
   if !file.IsDir() {
-    return fmt.Errorf("Source " + file.Name() + " is not a directory!")
+    return 0, fmt.Errorf("Source " + file.Name() + " is not a directory!")
   }
 
   err = os.Mkdir(toPath, 0755)
   if err != nil {
-    return err
+    return 0, err
+  }
+  err = logOperation(options, "created dir %s", toPath)
+  if err != nil {
+    return 0, err
   }
 
   files, err := ioutil.ReadDir(fromPath)
   if err != nil {
-    return err
+    return 0, err
   }
 
+  converted := 0
   for _, f := range files {
     if f.IsDir() {
-      err = copyDir(fromPath + "/" + f.Name(), toPath + "/" + f.Name())
+      n, err := copyDir(fromPath + "/" + f.Name(), toPath + "/" + f.Name(), options, copies)
+      converted += n
       if err != nil {
-        return err
+        return converted, err
       }
     }
     if !f.IsDir() {
-      err := copyFile(fromPath + "/" + f.Name(), toPath + "/" + f.Name())
+      n, err := copyFileDeduped(fromPath + "/" + f.Name(), toPath + "/" + f.Name(), f, options, copies)
+      converted += n
       if err != nil {
-        return err
+        return converted, err
+      }
+      if options.Stats != nil {
+        options.Stats.FilesProcessed++
+        options.Stats.BytesProcessed += f.Size()
       }
     }
   }
-  return nil
+  return converted, nil
 }
 
-/*
- * Guess the "Content-Type" of a file based on its first 512 bytes.
- * @param filePath the file to guess the content type of.
- * @returns the content type guess or an error
- */
-func FileContentType(filePath string) (string, error) {
-  // https://golangcode.com/get-the-content-type-of-file/
-  file, err := os.Open(filePath)
+// Like copyFileWithOptions(), but hard-links to an identical earlier copy if there is one.
+func copyFileDeduped(inPath string, outPath string, info os.FileInfo, options CopyDirOptions, copies map[string]dedupedCopy) (int, error) {
+  if copies == nil {
+    n, err := copyFileWithOptions(inPath, outPath, info, options)
+    if err == nil {
+      err = logOperation(options, "copied %s -> %s (%d bytes)", inPath, outPath, info.Size())
+    }
+    return n, err
+  }
+  digest, err := FileHash(inPath, sha256.New())
+  if err != nil {
+    return 0, err
+  }
+  // Line ending conversion is deterministic, so equal sources make equal copies.
+  key := fmt.Sprintf("%s %o", digest, info.Mode().Perm())
+  if earlier, ok := copies[key]; ok {
+    if os.Link(earlier.path, outPath) == nil {
+      return earlier.converted, logOperation(options, "linked %s -> %s", earlier.path, outPath)
+    }
+  }
+  n, err := copyFileWithOptions(inPath, outPath, info, options)
+  if err == nil {
+    copies[key] = dedupedCopy{outPath, n}
+    err = logOperation(options, "copied %s -> %s (%d bytes)", inPath, outPath, info.Size())
+  }
+  return n, err
+}
+
+// Copies a single file for CopyDirWithOptions(), returning 1 if its line endings were converted.
+func copyFileWithOptions(inPath string, outPath string, info os.FileInfo, options CopyDirOptions) (int, error) {
+  if info.Mode() & os.ModeSymlink != 0 {
+    // The link's target is copied, so it should get the target's mode, not the link's.
+    var err error
+    info, err = os.Stat(inPath)
+    if err != nil {
+      return 0, err
+    }
+  }
+  if options.LineEndingConversion == LineEndingNone {
+    return 0, copyFileKeepingMode(inPath, outPath, info)
+  }
+  binary, err := IsBinaryFile(inPath)
+  if err != nil {
+    return 0, err
+  }
+  if binary {
+    return 0, copyFileKeepingMode(inPath, outPath, info)
+  }
+  inFile, err := os.Open(inPath)
+  if err != nil {
+    return 0, err
+  }
+  defer inFile.Close()
+  outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+  if err != nil {
+    return 0, err
+  }
+  defer outFile.Close()
+  writer := bufio.NewWriter(outFile)
+  changed, err := convertLineEndings(bufio.NewReader(inFile), writer, options.LineEndingConversion)
+  if err != nil {
+    return 0, err
+  }
+  err = writer.Flush()
+  if err != nil {
+    return 0, err
+  }
+  // OpenFile's mode is only used for new files, and is subject to the umask.
+  err = outFile.Chmod(info.Mode().Perm())
+  if err != nil {
+    return 0, err
+  }
+  if changed {
+    return 1, nil
+  }
+  return 0, nil
+}
+
+// CopyFile() creates the copy with the default mode; this gives it the source's.
+func copyFileKeepingMode(inPath string, outPath string, info os.FileInfo) error {
+  err := CopyFile(inPath, outPath)
+  if err != nil {
+    return err
+  }
+  return os.Chmod(outPath, info.Mode().Perm())
+}
+
+// Copies reader to writer, rewriting "\n" and "\r\n" line endings. Lone "\r"s are left alone.
+func convertLineEndings(reader *bufio.Reader, writer io.Writer, conversion LineEndingConversion) (bool, error) {
+  changed := false
+  for {
+    line, err := reader.ReadBytes('\n')
+    if len(line) > 0 && line[len(line) - 1] == '\n' {
+      hasCR := len(line) >= 2 && line[len(line) - 2] == '\r'
+      content := line[:len(line) - 1]
+      if hasCR {
+        content = line[:len(line) - 2]
+      }
+      newline := "\n"
+      if conversion == LineEndingToCRLF {
+        newline = "\r\n"
+      }
+      if hasCR != (conversion == LineEndingToCRLF) {
+        changed = true
+      }
+      if _, writeErr := writer.Write(content); writeErr != nil {
+        return changed, writeErr
+      }
+      if _, writeErr := io.WriteString(writer, newline); writeErr != nil {
+        return changed, writeErr
+      }
+    } else if _, writeErr := writer.Write(line); writeErr != nil {
+      return changed, writeErr
+    }
+    if err == io.EOF {
+      return changed, nil
+    }
+    if err != nil {
+      return changed, err
+    }
+  }
+}
+
+/*
+ * Guess whether a file is binary (as opposed to text).
+ * @param filePath the file to check
+ * @returns whether the file looks binary, or an error
+ *
+ * Like git, this treats a file as binary if there is a NUL byte in its first 8000 bytes.
+ */
+func IsBinaryFile(filePath string) (bool, error) {
+  header, err := ReadFileHeader(filePath, 8000)
+  if err != nil {
+    return false, err
+  }
+  return bytes.IndexByte(header, 0) >= 0, nil
+}
+
+/*
+ * Incrementally copy a directory, copying only files whose contents changed since the last run.
+ * @param src the directory to copy
+ * @param dst the directory to copy into; it is created if needed
+ * @param stateFile a JSON file remembering each file's SHA-256 from the previous run
+ * @returns an error
+ *
+ * Unlike comparing modification times, this still skips unchanged files after
+ * something (like a git checkout) resets their mtimes. Every source file is
+ * hashed on each run, but only new or changed files (or ones missing from dst)
+ * are copied. Files deleted from src are forgotten, but not deleted from dst.
+ * The state file is only updated (atomically) once the copy succeeds.
+ */
+func CopyDirHashed(src string, dst string, stateFile string) error {
+  previous := map[string]string{}
+  data, err := ioutil.ReadFile(stateFile)
+  if err == nil {
+    err = json.Unmarshal(data, &previous)
+  }
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  current := map[string]string{}
+  err = filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(src, filePath)
+    if err != nil {
+      return err
+    }
+    outPath := filepath.Join(dst, relPath)
+    if info.IsDir() {
+      return os.MkdirAll(outPath, 0755)
+    }
+    digest, err := FileHash(filePath, sha256.New())
+    if err != nil {
+      return err
+    }
+    key := filepath.ToSlash(relPath)
+    current[key] = digest
+    if previous[key] == digest {
+      _, isFile, err := IsDirFile(outPath)
+      if err != nil {
+        return err
+      }
+      if isFile {
+        return nil
+      }
+    }
+    return CopyFile(filePath, outPath)
+  })
+  if err != nil {
+    return err
+  }
+  data, err = json.MarshalIndent(current, "", "  ")
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(stateFile, 0644, func(file *os.File) error {
+    _, err := file.Write(data)
+    return err
+  })
+}
+
+/*
+ * Guess the "Content-Type" of a file based on its first 512 bytes.
+ * @param filePath the file to guess the content type of.
+ * @returns the content type guess or an error
+ */
+func FileContentType(filePath string) (string, error) {
+  // https://golangcode.com/get-the-content-type-of-file/
+  buffer, err := ReadFileHeader(filePath, 512)
+  if err != nil {
+    return "", err
+  }
+  contentType := http.DetectContentType(buffer)
+  return contentType, nil
+}
+
+var preferredExtensions = map[string]string{
+  "image/jpeg": ".jpg",
+  "text/plain": ".txt",
+  "text/html": ".html",
+  "audio/mpeg": ".mp3",
+  "video/mp4": ".mp4",
+  "application/ogg": ".ogg",
+}
+
+/*
+ * Guess a file's content type and a suitable extension for it, e.g. for the
+ * "Content-Type" and "Content-Disposition" headers of a download.
+ * @param filePath the file to inspect
+ * @returns the content type, the extension (with its leading dot, or "" if unknown), and an error
+ *
+ * The content type is sniffed with FileContentType(). Then, in order:
+ * 1. If the file's current extension is registered for the sniffed type, both are kept.
+ * 2. If the sniff was inconclusive ("text/plain" or "application/octet-stream")
+ *    and the current extension has a more specific registered type, that type and
+ *    extension are used instead (so a ".json" file isn't reported as plain text).
+ *    For "text/plain", only textual types qualify.
+ * 3. Otherwise the extension is a preferred one for the type (".jpg" over ".jpe"),
+ *    or the first from mime.ExtensionsByType(), or "" if the type has none.
+ */
+func FileTypeInfo(filePath string) (string, string, error) {
+  contentType, err := FileContentType(filePath)
+  if err != nil {
+    return "", "", err
+  }
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return "", "", err
+  }
+  currentExtension := strings.ToLower(filepath.Ext(filePath))
+  if currentExtension != "" {
+    extensionType, _, _ := mime.ParseMediaType(mime.TypeByExtension(currentExtension))
+    if extensionType == mediaType {
+      return contentType, currentExtension, nil
+    }
+    textual := strings.HasPrefix(extensionType, "text/") || strings.HasSuffix(extensionType, "json") || strings.HasSuffix(extensionType, "xml") || strings.HasSuffix(extensionType, "javascript")
+    if extensionType != "" && (mediaType == "application/octet-stream" || (mediaType == "text/plain" && textual)) {
+      return mime.TypeByExtension(currentExtension), currentExtension, nil
+    }
+  }
+  if extension, ok := preferredExtensions[mediaType]; ok {
+    return contentType, extension, nil
+  }
+  extensions, err := mime.ExtensionsByType(mediaType)
+  if err != nil {
+    return "", "", err
+  }
+  if len(extensions) == 0 {
+    return contentType, "", nil
+  }
+  return contentType, extensions[0], nil
+}
+
+/*
+ * Read the first bytes of a file without reading the rest of it.
+ * @param filePath the file to read
+ * @param n the maximum number of bytes to read
+ * @returns the first n bytes (or the whole file, if it is shorter) or an error
+ */
+func ReadFileHeader(filePath string, n int) ([]byte, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  buffer := make([]byte, n)
+  read, err := io.ReadFull(file, buffer)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return nil, err
+  }
+  return buffer[:read], nil
+}
+
+type magicSignature struct {
+  offset int
+  magic []byte
+  mimeType string
+}
+
+var magicSignaturesLock sync.RWMutex
+var magicSignatures = []magicSignature{
+  {0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+  {0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+  {0, []byte("BZh"), "application/x-bzip2"},
+  {0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+  {257, []byte("ustar"), "application/x-tar"},
+  {0, []byte("II*\x00"), "image/tiff"},
+  {0, []byte("MM\x00*"), "image/tiff"},
+  {4, []byte("ftypheic"), "image/heic"},
+  {4, []byte("ftypavif"), "image/avif"},
+  {0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+  {0, []byte("\x7FELF"), "application/x-elf"},
+}
+
+/*
+ * Teach DetectMagic() a new format.
+ * @param offset where in the file the magic number starts
+ * @param magic the bytes that identify the format
+ * @param mimeType the content type to report for matching files
+ *
+ * Signatures registered later take precedence over earlier ones (including the built-in ones).
+ */
+func RegisterMagic(offset int, magic []byte, mimeType string) {
+  magicSignaturesLock.Lock()
+  defer magicSignaturesLock.Unlock()
+  magicSignatures = append([]magicSignature{{offset, magic, mimeType}}, magicSignatures...)
+}
+
+/*
+ * Guess the content type of some data based on its magic number.
+ * @param header the first bytes of a file (see ReadFileHeader())
+ * @returns the content type guess
+ *
+ * Formats registered with RegisterMagic() are checked first; if none match, this
+ * falls back to http.DetectContentType(). Some signatures (e.g. tar) need more than
+ * 512 bytes, so read a header of at least a few KB.
+ */
+func DetectMagic(header []byte) string {
+  magicSignaturesLock.RLock()
+  defer magicSignaturesLock.RUnlock()
+  for _, signature := range magicSignatures {
+    end := signature.offset + len(signature.magic)
+    if end <= len(header) && bytes.Equal(header[signature.offset:end], signature.magic) {
+      return signature.mimeType
+    }
+  }
+  return http.DetectContentType(header)
+}
+
+/*
+ * Computes a hexadecimal hash of the file at the given path
+ * @param filePath the file to compute the has of
+ * @param hasher which hashing algorithm to use
+ * @returns the hexadecimal hash or an error
+ *
+ * Example Usage:
+ *   import (
+ *     "crypto/md5"
+ *     "crypto/sha256"
+ *   )
+ *   func main() {
+ *     md5Hash, err := util.FileHash("foo.png", md5.New())
+ *     sha256Hash, err := util.FileHash("foo.png", sha256.New())
+ *   }
+ */
+func FileHash(filePath string, hasher hash.Hash) (string, error) {
+  // https://stackoverflow.com/a/40436529/4004969
+  file, err := os.Open(filePath)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  if _, err := io.Copy(hasher, file); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+ * Compute an ETag header value for a file.
+ * @param filePath the file to compute the ETag of
+ * @param strong whether to hash the file's contents (see below)
+ * @returns the quoted ETag, e.g. W/"1a2b-17d9c3f2a1b" or "9f86d0...", or an error
+ *
+ * A weak ETag is built from the file's size and modification time. It costs
+ * one stat, but changes whenever the file is touched (even if its contents
+ * don't), and could miss a same-size edit within the filesystem's timestamp
+ * resolution. A strong ETag is the file's SHA-256 (via FileHash()), which
+ * is exact but reads the whole file every time, so cache it for large files.
+ */
+func FileETag(filePath string, strong bool) (string, error) {
+  if strong {
+    digest, err := FileHash(filePath, sha256.New())
+    if err != nil {
+      return "", err
+    }
+    return `"` + digest + `"`, nil
+  }
+  info, err := os.Stat(filePath)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+/*
+ * Options for NormalizedTextHash().
+ */
+type TextHashOptions struct {
+  // Treat "\r\n" and lone "\r" line endings as "\n". This is what makes a CRLF <-> LF
+  // conversion hash the same, so it's almost always wanted.
+  NormalizeLineEndings bool
+  // Ignore spaces and tabs at the end of each line.
+  TrimTrailingWhitespace bool
+  // Hash binary files (see IsBinaryFile()) as-is instead of returning an error.
+  HashBinaryRaw bool
+}
+
+/*
+ * Computes a hexadecimal hash of a text file that ignores cosmetic differences.
+ * @param filePath the file to compute the hash of
+ * @param hasher which hashing algorithm to use
+ * @param options which differences to ignore
+ * @returns the hexadecimal hash or an error (including for binary files, unless options.HashBinaryRaw)
+ *
+ * Useful for change detection that shouldn't fire when an editor on another
+ * platform rewrote a file's line endings or trailing whitespace.
+ */
+func NormalizedTextHash(filePath string, hasher hash.Hash, options TextHashOptions) (string, error) {
+  binary, err := IsBinaryFile(filePath)
+  if err != nil {
+    return "", err
+  }
+  if binary {
+    if options.HashBinaryRaw {
+      return FileHash(filePath, hasher)
+    }
+    return "", fmt.Errorf("%s is not a text file", filePath)
+  }
+  file, err := os.Open(filePath)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  reader := bufio.NewReader(file)
+  for {
+    line, err := reader.ReadBytes('\n')
+    if err != nil && err != io.EOF {
+      return "", err
+    }
+    content := bytes.TrimSuffix(line, []byte("\n"))
+    newline := line[len(content):]
+    if options.NormalizeLineEndings {
+      content = bytes.TrimSuffix(content, []byte("\r"))
+      if len(newline) > 0 {
+        newline = []byte("\n")
+      }
+      // Lone carriage returns (classic Mac OS) are line endings too.
+      content = bytes.ReplaceAll(content, []byte("\r"), []byte("\n"))
+    }
+    if options.TrimTrailingWhitespace {
+      lines := bytes.Split(content, []byte("\n"))
+      for i := range lines {
+        crlf := bytes.HasSuffix(lines[i], []byte("\r"))
+        lines[i] = bytes.TrimRight(lines[i], " \t\r")
+        if crlf && !options.NormalizeLineEndings {
+          lines[i] = append(lines[i], '\r')
+        }
+      }
+      content = bytes.Join(lines, []byte("\n"))
+    }
+    hasher.Write(content)
+    hasher.Write(newline)
+    if err == io.EOF {
+      break
+    }
+  }
+  return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+ * Like FileHash(), but salvages what it can from a file that can't be fully read.
+ * @param filePath the file to compute the hash of
+ * @param hasher which hashing algorithm to use
+ * @returns the hexadecimal hash of the bytes that were read, how many bytes that was, and an error
+ *
+ * If a read fails partway through (e.g. a bad sector), the hash and count cover
+ * everything read before the failure, and the error is returned alongside them.
+ * If the file can't be opened at all, the hash is "".
+ */
+func FileHashPartial(filePath string, hasher hash.Hash) (string, int64, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return "", 0, err
+  }
+  defer file.Close()
+  n, err := io.Copy(hasher, file)
+  return hex.EncodeToString(hasher.Sum(nil)), n, err
+}
+
+/*
+ * Checks whether a file or directory exists at the given path
+ * @param path the path to check
+ * @returns (whether the entity is a directory, whether the entity is a file, error)
+ *
+ * Exhaustive interpretations:
+ * (false, false, nil)    no entity exists here
+ * (true, false, nil)     a directory exists here
+ * (false, true, nil)     a file exists here
+ * (false, false, error)  an error occured
+ */
+func IsDirFile(filePath string) (bool, bool, error) {
+  file, err := os.Open(filePath)
+  if os.IsNotExist(err) {
+    return false, false, nil
+  }
+  if err != nil {
+    return false, false, err
+  }
+  defer file.Close()
+
+  fileInfo, err := file.Stat()
+  if err != nil {
+    return false, false, err
+  }
+  rtn := fileInfo.IsDir()
+  return rtn, !rtn, nil
+}
+
+/*
+ * Zip a file.
+ * @param filePath the file to compress
+ * @param where to place the newly created ZIP file.
+ * @returns an error
+ */
+func ZipFile(filePath string, zipFilePath string) error {
+  archive, err := os.Create(zipFilePath)
+  if err != nil {
+    return err
+  }
+  defer archive.Close()
+  zipWriter := zip.NewWriter(archive)
+  defer zipWriter.Close()
+
+  f1, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer f1.Close()
+
+  w1, err := zipWriter.Create(path.Base(filePath))
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(w1, f1); err != nil {
+    return err
+  }
+  return nil
+}
+
+/*
+ * Zip a directory.
+ * @param dirPath the directory to compress
+ * @param where to place the newly created ZIP file.
+ * @returns an error
+ */
+func ZipDir(dirPath string, zipFilePath string) error {
+  return ZipDirWithOptions(dirPath, zipFilePath, ZipDirOptions{})
+}
+
+/*
+ * Options for ZipDirWithOptions(). The zero value behaves like ZipDir().
+ */
+type ZipDirOptions struct {
+  // If set, the zipped files, bytes (uncompressed), and elapsed time are added to it.
+  Stats *OpStats
+  // If set, add a MANIFEST.json entry with each file's hash (see ZipDirWithManifest()).
+  ManifestHasher func() hash.Hash
+}
+
+/*
+ * Zip a directory.
+ * @param dirPath the directory to compress
+ * @param where to place the newly created ZIP file.
+ * @param options how to zip
+ * @returns an error
+ */
+func ZipDirWithOptions(dirPath string, zipFilePath string, options ZipDirOptions) error {
+  // https://stackoverflow.com/a/63233911/4004969
+  if options.Stats != nil {
+    start := time.Now()
+    defer func() { options.Stats.Elapsed += time.Since(start) }()
+  }
+  file, err := os.Create(zipFilePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  w := zip.NewWriter(file)
+  defer w.Close()
+
+  manifest := zipManifest{}
+  if options.ManifestHasher != nil {
+    manifest.Algorithm, err = hashAlgorithmName(options.ManifestHasher)
+    if err != nil {
+      return err
+    }
+    if _, err := os.Lstat(filepath.Join(dirPath, zipManifestName)); err == nil {
+      return fmt.Errorf("%s already contains a %s", dirPath, zipManifestName)
+    }
+    manifest.Hashes = map[string]string{}
+  }
+
+  walker := func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if info.IsDir() {
+      return nil
+    }
+    file, err := os.Open(path)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+
+    // Ensure that `path` is not absolute; it should not start with "/".
+    // This snippet happens to work because I don't use 
+    // absolute paths, but ensure your real-world code 
+    // transforms path into a zip-root relative path.
+    // TODO
+    f, err := w.Create(path[len(dirPath):])
+    if err != nil {
+      return err
+    }
+
+    var reader io.Reader = file
+    var hasher hash.Hash
+    if manifest.Hashes != nil {
+      hasher = options.ManifestHasher()
+      reader = io.TeeReader(file, hasher)
+    }
+    n, err := io.Copy(f, reader)
+    if err != nil {
+      return err
+    }
+    if hasher != nil {
+      manifest.Hashes[path[len(dirPath):]] = hex.EncodeToString(hasher.Sum(nil))
+    }
+    if options.Stats != nil {
+      options.Stats.FilesProcessed++
+      options.Stats.BytesProcessed += n
+    }
+
+    return nil
+  }
+  err = filepath.Walk(dirPath, walker)
+  if err != nil {
+    return err
+  }
+  if manifest.Hashes != nil {
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+      return err
+    }
+    f, err := w.Create(zipManifestName)
+    if err != nil {
+      return err
+    }
+    _, err = f.Write(data)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+const zipManifestName = "MANIFEST.json"
+
+// The contents of the MANIFEST.json written by ZipDirWithManifest().
+type zipManifest struct {
+  Algorithm string
+  // Maps each entry's name to the hex-encoded hash of its contents.
+  Hashes map[string]string
+}
+
+// The hashes a manifest can be made with, by name.
+var manifestHashers = map[string]func() hash.Hash{
+  "md5": md5.New,
+  "sha1": sha1.New,
+  "sha224": sha256.New224,
+  "sha256": sha256.New,
+  "sha384": sha512.New384,
+  "sha512": sha512.New,
+}
+
+// Works out which of manifestHashers newHasher makes, by what it gives for no input.
+func hashAlgorithmName(newHasher func() hash.Hash) (string, error) {
+  empty := hex.EncodeToString(newHasher().Sum(nil))
+  for name, known := range manifestHashers {
+    if hex.EncodeToString(known().Sum(nil)) == empty {
+      return name, nil
+    }
+  }
+  return "", errors.New("unsupported manifest hash; use MD5, SHA-1, SHA-224, SHA-256, SHA-384, or SHA-512")
+}
+
+/*
+ * Zip a directory along with a manifest of its files' hashes, making the archive tamper-evident.
+ * @param dirPath the directory to compress
+ * @param zipFilePath where to place the newly created ZIP file
+ * @param newHasher makes the hash to use, e.g. sha256.New (MD5, SHA-1, and SHA-2 are supported)
+ * @returns an error, including if dirPath already has a MANIFEST.json at its top
+ *
+ * The manifest is an extra "MANIFEST.json" entry holding the hash algorithm and
+ * the hash of every other entry. Check an archive with VerifyZipWithManifest().
+ * This detects accidental or casual changes; someone able to edit the archive
+ * can rewrite the manifest too, so sign the archive if that matters.
+ */
+func ZipDirWithManifest(dirPath string, zipFilePath string, newHasher func() hash.Hash) error {
+  return ZipDirWithOptions(dirPath, zipFilePath, ZipDirOptions{ManifestHasher: newHasher})
+}
+
+/*
+ * Check a zip made by ZipDirWithManifest() against its manifest.
+ * @param zipFilePath the zip file to check
+ * @returns one line per problem (empty if the archive is intact), or an error (e.g. if there's no manifest)
+ *
+ * Problems are "modified: name" (the hash doesn't match), "missing: name" (in the
+ * manifest but not the archive), and "unlisted: name" (in the archive but not the manifest).
+ */
+func VerifyZipWithManifest(zipFilePath string) ([]string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  manifest := zipManifest{}
+  found := false
+  for _, f := range r.File {
+    if f.Name != zipManifestName {
+      continue
+    }
+    rc, err := f.Open()
+    if err != nil {
+      return nil, err
+    }
+    err = json.NewDecoder(rc).Decode(&manifest)
+    rc.Close()
+    if err != nil {
+      return nil, fmt.Errorf("invalid %s: %w", zipManifestName, err)
+    }
+    found = true
+  }
+  if !found {
+    return nil, fmt.Errorf("%s has no %s", zipFilePath, zipManifestName)
+  }
+  newHasher, ok := manifestHashers[manifest.Algorithm]
+  if !ok {
+    return nil, fmt.Errorf("unsupported manifest hash: %s", manifest.Algorithm)
+  }
+  problems := []string{}
+  seen := map[string]bool{}
+  for _, f := range r.File {
+    if f.Name == zipManifestName || f.FileInfo().IsDir() {
+      continue
+    }
+    seen[f.Name] = true
+    expected, ok := manifest.Hashes[f.Name]
+    if !ok {
+      problems = append(problems, "unlisted: " + f.Name)
+      continue
+    }
+    rc, err := f.Open()
+    if err != nil {
+      return nil, err
+    }
+    hasher := newHasher()
+    _, err = io.Copy(hasher, rc)
+    rc.Close()
+    // A checksum error means the contents changed, which is what we're looking for.
+    if err != nil && err != zip.ErrChecksum {
+      return nil, err
+    }
+    if err != nil || hex.EncodeToString(hasher.Sum(nil)) != expected {
+      problems = append(problems, "modified: " + f.Name)
+    }
+  }
+  names := make([]string, 0, len(manifest.Hashes))
+  for name := range manifest.Hashes {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    if !seen[name] {
+      problems = append(problems, "missing: " + name)
+    }
+  }
+  return problems, nil
+}
+
+/*
+ * Serve the contents of a zip file, e.g. with http.FileServer().
+ * @param zipFilePath the zip file to serve
+ * @returns a file system backed by the archive, or an error
+ *
+ * The archive stays open for as long as the file system is in use. The returned
+ * value also implements io.Closer, which closes it.
+ * Entries are opened lazily: stored (uncompressed) entries are read straight from
+ * the archive, while compressed entries are decompressed into memory the first time
+ * they are read, since they can't otherwise be seeked.
+ * Entry names that would escape the archive's root (e.g. "../foo") are not served.
+ */
+func ZipFileSystem(zipFilePath string) (http.FileSystem, error) {
+  file, err := os.Open(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  info, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+  reader, err := zip.NewReader(file, info.Size())
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+  fileSystem := &zipFileSystem{
+    file: file,
+    files: map[string]*zip.File{},
+    dirs: map[string]map[string]os.FileInfo{"": {}},
+    modTime: info.ModTime(),
+  }
+  for _, f := range reader.File {
+    name := path.Clean(strings.ReplaceAll(f.Name, "\\", "/"))
+    if name == "." || name == ".." || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "/") {
+      continue
+    }
+    if f.FileInfo().IsDir() {
+      fileSystem.addDir(name, f.FileInfo())
+    } else {
+      fileSystem.files[name] = f
+      fileSystem.addDir(path.Dir(name), nil)
+      fileSystem.dirs[dirKey(path.Dir(name))][path.Base(name)] = f.FileInfo()
+    }
+  }
+  return fileSystem, nil
+}
+
+type zipFileSystem struct {
+  file *os.File
+  files map[string]*zip.File
+  // Directory name ("" for the root) -> child name -> child info.
+  dirs map[string]map[string]os.FileInfo
+  modTime time.Time
+}
+
+func dirKey(name string) string {
+  if name == "." {
+    return ""
+  }
+  return name
+}
+
+// Registers a directory and all its ancestors. info may be nil for implicit directories.
+func (fileSystem *zipFileSystem) addDir(name string, info os.FileInfo) {
+  name = dirKey(name)
+  if _, ok := fileSystem.dirs[name]; !ok {
+    fileSystem.dirs[name] = map[string]os.FileInfo{}
+  }
+  if name == "" {
+    return
+  }
+  parent := dirKey(path.Dir(name))
+  if info == nil {
+    if existing, ok := fileSystem.dirs[parent][path.Base(name)]; ok {
+      info = existing
+    } else {
+      info = zipDirInfo{path.Base(name), fileSystem.modTime}
+    }
+  }
+  fileSystem.addDir(parent, nil)
+  fileSystem.dirs[parent][path.Base(name)] = info
+}
+
+func (fileSystem *zipFileSystem) Open(name string) (http.File, error) {
+  name = path.Clean("/" + name)[1:]
+  if f, ok := fileSystem.files[name]; ok {
+    return &zipEntryFile{entry: f, archive: fileSystem.file}, nil
+  }
+  if children, ok := fileSystem.dirs[name]; ok {
+    info := os.FileInfo(zipDirInfo{"/", fileSystem.modTime})
+    if name != "" {
+      info = fileSystem.dirs[dirKey(path.Dir(name))][path.Base(name)]
+    }
+    entries := []os.FileInfo{}
+    for _, child := range children {
+      entries = append(entries, child)
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+    return &zipDirFile{info: info, entries: entries}, nil
+  }
+  return nil, os.ErrNotExist
+}
+
+func (fileSystem *zipFileSystem) Close() error {
+  return fileSystem.file.Close()
+}
+
+type zipDirInfo struct {
+  name string
+  modTime time.Time
+}
+
+func (info zipDirInfo) Name() string { return info.name }
+func (info zipDirInfo) Size() int64 { return 0 }
+func (info zipDirInfo) Mode() os.FileMode { return os.ModeDir | 0555 }
+func (info zipDirInfo) ModTime() time.Time { return info.modTime }
+func (info zipDirInfo) IsDir() bool { return true }
+func (info zipDirInfo) Sys() interface{} { return nil }
+
+type zipDirFile struct {
+  info os.FileInfo
+  entries []os.FileInfo
+  offset int
+}
+
+func (dir *zipDirFile) Close() error { return nil }
+func (dir *zipDirFile) Read([]byte) (int, error) { return 0, errors.New("is a directory") }
+func (dir *zipDirFile) Seek(int64, int) (int64, error) { return 0, errors.New("is a directory") }
+func (dir *zipDirFile) Stat() (os.FileInfo, error) { return dir.info, nil }
+
+func (dir *zipDirFile) Readdir(count int) ([]os.FileInfo, error) {
+  remaining := dir.entries[dir.offset:]
+  if count <= 0 {
+    dir.offset = len(dir.entries)
+    return remaining, nil
+  }
+  if len(remaining) == 0 {
+    return nil, io.EOF
+  }
+  if count > len(remaining) {
+    count = len(remaining)
+  }
+  dir.offset += count
+  return remaining[:count], nil
+}
+
+type zipEntryFile struct {
+  entry *zip.File
+  archive *os.File
+  // Set on the first Read().
+  content io.ReadSeeker
+  offset int64
+}
+
+func (file *zipEntryFile) Close() error { return nil }
+func (file *zipEntryFile) Stat() (os.FileInfo, error) { return file.entry.FileInfo(), nil }
+
+func (file *zipEntryFile) Readdir(int) ([]os.FileInfo, error) {
+  return nil, errors.New("not a directory")
+}
+
+func (file *zipEntryFile) Seek(offset int64, whence int) (int64, error) {
+  switch whence {
+  case io.SeekStart:
+  case io.SeekCurrent:
+    offset += file.offset
+  case io.SeekEnd:
+    offset += int64(file.entry.UncompressedSize64)
+  default:
+    return 0, errors.New("invalid whence")
+  }
+  if offset < 0 {
+    return 0, errors.New("negative position")
+  }
+  file.offset = offset
+  return offset, nil
+}
+
+func (file *zipEntryFile) Read(buffer []byte) (int, error) {
+  if file.content == nil {
+    if file.entry.Method == zip.Store {
+      dataOffset, err := file.entry.DataOffset()
+      if err != nil {
+        return 0, err
+      }
+      file.content = io.NewSectionReader(file.archive, dataOffset, int64(file.entry.UncompressedSize64))
+    } else {
+      rc, err := file.entry.Open()
+      if err != nil {
+        return 0, err
+      }
+      data, err := ioutil.ReadAll(rc)
+      rc.Close()
+      if err != nil {
+        return 0, err
+      }
+      file.content = bytes.NewReader(data)
+    }
+  }
+  _, err := file.content.Seek(file.offset, io.SeekStart)
+  if err != nil {
+    return 0, err
+  }
+  n, err := file.content.Read(buffer)
+  file.offset += int64(n)
+  return n, err
+}
+
+/*
+ * Unzip a zip file.
+ */
+func Unzip(zipFilePath string, destinationPath string) error {
+  return UnzipWithOptions(zipFilePath, destinationPath, UnzipOptions{})
+}
+
+/*
+ * Options for UnzipWithOptions(). The zero value behaves like Unzip().
+ */
+type UnzipOptions struct {
+  // If set (e.g. to "windows"), entry names that are illegal on that OS are
+  // rewritten before extracting (see ValidateZipForOS()) instead of failing.
+  SanitizeNamesFor string
+  // Remove this many leading path segments from each entry's name, like tar's
+  // --strip-components (e.g. 1 turns "project-1.0/src/a.go" into "src/a.go").
+  // Entries with no segments left are skipped.
+  StripComponents int
+  // If positive, fail with a *PathLimitError (before extracting anything) if an
+  // entry has more path segments than this ("a/b/c.txt" has 3). This guards against
+  // pathologically nested archives.
+  MaxDepth int
+  // If positive, fail with a *PathLimitError (before extracting anything) if an
+  // entry's destination path would be longer than this many bytes, rather than
+  // hitting ENAMETOOLONG (or Windows' MAX_PATH of 260) partway through.
+  MaxPathLength int
+  // What to do with files whose names differ only by case (see DetectCaseCollisions()).
+  // By default they're extracted as-is, so on a case-insensitive filesystem
+  // (the default on macOS and Windows) the last one wins.
+  CaseCollisions CaseCollisionMode
+}
+
+/*
+ * How UnzipWithOptions() handles entries whose names differ only by case.
+ */
+type CaseCollisionMode int
+
+const (
+  // Extract every entry under its own name.
+  CaseCollisionIgnore CaseCollisionMode = iota
+  // Fail (before extracting anything) with an error wrapping ErrCaseCollision.
+  CaseCollisionError
+  // Keep the first entry's name and add "_2", "_3", ... before the extension of later ones.
+  CaseCollisionRename
+)
+
+var ErrCaseCollision = errors.New("Zip entry names differ only by case")
+
+/*
+ * Unzip a zip file.
+ * @param zipFilePath the zip file to extract
+ * @param destinationPath the directory to create and extract into
+ * @param options how to extract
+ * @returns an error
+ */
+func UnzipWithOptions(zipFilePath string, destinationPath string, options UnzipOptions) error {
+  // https://stackoverflow.com/a/24792688/4004969
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+  // Work out (and check) every entry's destination before writing anything.
+  type extraction struct {
+    f *zip.File
+    path string
+  }
+  extractions := []extraction{}
+  // Lowercased destination paths of files, for CaseCollisions.
+  seenPaths := map[string]string{}
+  for _, f := range r.File {
+    name := f.Name
+    if options.SanitizeNamesFor != "" {
+      name = sanitizeZipName(name, options.SanitizeNamesFor)
+    }
+    if options.StripComponents > 0 {
+      var ok bool
+      name, ok = stripComponents(name, options.StripComponents)
+      if !ok {
+        continue
+      }
+    }
+    path, err := zipEntryPath(destinationPath, name)
+    if err != nil {
+      return err
+    }
+    if options.MaxDepth > 0 {
+      depth := len(strings.Split(strings.Trim(path[len(filepath.Clean(destinationPath)) + 1:], string(os.PathSeparator)), string(os.PathSeparator)))
+      if depth > options.MaxDepth {
+        return &PathLimitError{f.Name, fmt.Sprintf("is nested %d levels deep, more than the limit of %d", depth, options.MaxDepth)}
+      }
+    }
+    if options.CaseCollisions != CaseCollisionIgnore && !f.FileInfo().IsDir() {
+      key := strings.ToLower(path)
+      for count := 2; seenPaths[key] != ""; count++ {
+        if options.CaseCollisions == CaseCollisionError {
+          return fmt.Errorf("%w: %s and %s", ErrCaseCollision, seenPaths[key], f.Name)
+        }
+        extension := filepath.Ext(name)
+        path, err = zipEntryPath(destinationPath, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, extension), count, extension))
+        if err != nil {
+          return err
+        }
+        key = strings.ToLower(path)
+      }
+      seenPaths[key] = f.Name
+    }
+    if options.MaxPathLength > 0 && len(path) > options.MaxPathLength {
+      return &PathLimitError{f.Name, fmt.Sprintf("would be extracted to a path of %d bytes, more than the limit of %d", len(path), options.MaxPathLength)}
+    }
+    extractions = append(extractions, extraction{f, path})
+  }
+  err = os.Mkdir(destinationPath, 0755)
+  if err != nil {
+    return err
+  }
+  for _, e := range extractions {
+    err = extractZipEntry(e.f, e.path)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/*
+ * Find the files in a zip whose names differ only by case, which would overwrite
+ * each other when extracted onto a case-insensitive filesystem (e.g. on macOS or Windows).
+ * @param zipFilePath the zip file to check
+ * @returns each group of colliding entry names, in archive order, or an error
+ *
+ * Names are compared with strings.ToLower(), which matches what those filesystems
+ * do for nearly all real names. Directory entries that differ only by case merge
+ * harmlessly, so they aren't reported. See UnzipOptions.CaseCollisions for
+ * extracting such archives safely.
+ */
+func DetectCaseCollisions(zipFilePath string) ([][]string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  groups := map[string][]string{}
+  keys := []string{}
+  for _, f := range r.File {
+    if f.FileInfo().IsDir() {
+      continue
+    }
+    key := strings.ToLower(path.Clean("/" + strings.ReplaceAll(f.Name, "\\", "/")))
+    if _, ok := groups[key]; !ok {
+      keys = append(keys, key)
+    }
+    groups[key] = append(groups[key], f.Name)
+  }
+  collisions := [][]string{}
+  for _, key := range keys {
+    if len(groups[key]) > 1 {
+      collisions = append(collisions, groups[key])
+    }
+  }
+  return collisions, nil
+}
+
+// Removes the first count segments of an archive entry name, like tar's
+// --strip-components. Returns false if no segments are left.
+func stripComponents(name string, count int) (string, bool) {
+  segments := strings.Split(strings.TrimLeft(strings.ReplaceAll(name, "\\", "/"), "/"), "/")
+  if len(segments) <= count || strings.Join(segments[count:], "") == "" {
+    return "", false
+  }
+  return strings.Join(segments[count:], "/"), true
+}
+
+/*
+ * Returned by UnzipWithOptions() for an entry that exceeds its MaxDepth or MaxPathLength,
+ * and by UntarGzWithOptions() for one that exceeds its MaxDepth.
+ */
+type PathLimitError struct {
+  // The entry's name in the archive.
+  Name string
+  Reason string
+}
+
+func (err *PathLimitError) Error() string {
+  return "archive entry " + err.Name + " " + err.Reason
+}
+
+var windowsReservedNames = map[string]bool{
+  "CON": true, "PRN": true, "AUX": true, "NUL": true,
+  "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+  "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+/*
+ * Find the entries of a zip file whose names can't be extracted on the given OS.
+ * @param zipFilePath the zip file to check
+ * @param targetOS the OS the archive will be extracted on, as in runtime.GOOS
+ * @returns the problematic entry names, or an error
+ *
+ * On Windows, names may not contain control characters or any of <>:"|?*, no path
+ * segment may end in a dot or space, and device names like CON, NUL, or COM1 are
+ * reserved (even with an extension, e.g. "con.txt"). Elsewhere only NUL bytes are illegal.
+ */
+func ValidateZipForOS(zipFilePath string, targetOS string) ([]string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  problems := []string{}
+  for _, f := range r.File {
+    if sanitizeZipName(f.Name, targetOS) != f.Name {
+      problems = append(problems, f.Name)
+    }
+  }
+  return problems, nil
+}
+
+// Rewrites each segment of a slash-separated zip entry name so it is legal on targetOS.
+func sanitizeZipName(name string, targetOS string) string {
+  if targetOS != "windows" {
+    return strings.ReplaceAll(name, "\x00", "_")
+  }
+  segments := strings.Split(name, "/")
+  for i, segment := range segments {
+    segment = strings.Map(func(r rune) rune {
+      if r < 32 || strings.ContainsRune(`<>:"|?*`, r) {
+        return '_'
+      }
+      return r
+    }, segment)
+    // The last segment of a directory entry is empty, and "." and ".." are handled by the ZipSlip check.
+    if segment != "" && segment != "." && segment != ".." {
+      trimmed := strings.TrimRight(segment, ". ")
+      if trimmed != segment {
+        segment = trimmed + "_"
+      }
+    }
+    base := segment
+    if dot := strings.Index(segment, "."); dot >= 0 {
+      base = segment[:dot]
+    }
+    if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+      segment = base + "_" + segment[len(base):]
+    }
+    segments[i] = segment
+  }
+  return strings.Join(segments, "/")
+}
+
+/*
+ * Options for SanitizeFilenameWithOptions().
+ */
+type SanitizeOptions struct {
+  // Only keep ASCII letters, digits, '.', '-', and '_' (and not a leading '.', so
+  // no hidden files), replacing everything else with '_'. Otherwise any printable
+  // Unicode is kept and only characters that are unsafe somewhere are replaced.
+  Strict bool
+}
+
+var ErrInvalidFilename = errors.New("Filename can't be made safe")
+
+/*
+ * Turn an untrusted filename (e.g. from an upload) into one that is safe to create in a directory.
+ * @param name the filename to clean
+ * @returns the cleaned name, or ErrInvalidFilename if nothing usable is left
+ *
+ * Same as SanitizeFilenameWithOptions() with the default (Unicode-permissive) options.
+ */
+func SanitizeFilename(name string) (string, error) {
+  return SanitizeFilenameWithOptions(name, SanitizeOptions{})
+}
+
+/*
+ * Turn an untrusted filename (e.g. from an upload) into one that is safe to create in a directory.
+ * @param name the filename to clean
+ * @param options how aggressively to clean it
+ * @returns the cleaned name, or ErrInvalidFilename if nothing usable is left
+ *
+ * Any directory part (with either slash) is dropped, so "../../etc/passwd" and
+ * "C:\Users\me\a.txt" become "passwd" and "a.txt". Control characters, invalid
+ * UTF-8, and the characters Windows forbids (<>:"|?*) become '_'. Leading spaces
+ * and trailing dots and spaces are trimmed, Windows device names get a '_' as in
+ * ValidateZipForOS() (so "con.txt" becomes "con_.txt"), and names are cut to 255
+ * bytes, keeping a short extension. The rules are the same on every OS, so a
+ * name that's safe here is safe everywhere.
+ */
+func SanitizeFilenameWithOptions(name string, options SanitizeOptions) (string, error) {
+  name = strings.ReplaceAll(name, "\\", "/")
+  name = name[strings.LastIndex(name, "/") + 1:]
+  name = strings.Map(func(r rune) rune {
+    if options.Strict {
+      if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+        return r
+      }
+      return '_'
+    }
+    if r == utf8.RuneError || unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+      return '_'
+    }
+    return r
+  }, name)
+  name = strings.TrimLeft(name, " ")
+  name = strings.TrimRight(name, ". ")
+  if options.Strict && strings.HasPrefix(name, ".") {
+    name = "_" + name[1:]
+  }
+  if name == "" || name == "." || name == ".." {
+    return "", ErrInvalidFilename
+  }
+  base := name
+  if dot := strings.Index(name, "."); dot >= 0 {
+    base = name[:dot]
+  }
+  if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+    name = base + "_" + name[len(base):]
+  }
+  if len(name) > 255 {
+    ext := filepath.Ext(name)
+    if len(ext) > 32 {
+      ext = ""
+    }
+    stem := name[:255 - len(ext)]
+    // Don't cut a character in half.
+    for !utf8.ValidString(stem) {
+      stem = stem[:len(stem) - 1]
+    }
+    name = strings.TrimRight(stem, ". ") + ext
+  }
+  return name, nil
+}
+
+/*
+ * Guess the text encoding of a file.
+ * @param filePath the file to inspect
+ * @returns one of "UTF-8", "UTF-16LE", "UTF-16BE", or "ISO-8859-1", or an error
+ *
+ * A byte order mark wins if present. Otherwise the first 64 KB are sampled:
+ * lots of NUL bytes in alternating positions suggests BOM-less UTF-16, valid
+ * UTF-8 (which includes plain ASCII) is reported as UTF-8, and anything else
+ * with high-bit bytes falls back to ISO-8859-1. This is a best-effort guess.
+ */
+func DetectEncoding(filePath string) (string, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  buffer := make([]byte, 64 * 1024)
+  n, err := io.ReadFull(file, buffer)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return "", err
+  }
+  return detectEncoding(buffer[:n]), nil
+}
+
+func detectEncoding(data []byte) string {
+  if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+    return "UTF-8"
+  }
+  if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+    return "UTF-16LE"
+  }
+  if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+    return "UTF-16BE"
+  }
+  // ASCII text encoded as UTF-16 has a NUL in every other byte.
+  evenZeros, oddZeros := 0, 0
+  for i, b := range data {
+    if b != 0 {
+      continue
+    }
+    if i % 2 == 0 {
+      evenZeros++
+    } else {
+      oddZeros++
+    }
+  }
+  half := len(data) / 2
+  if half > 0 && oddZeros * 10 > half * 3 && evenZeros * 10 < half {
+    return "UTF-16LE"
+  }
+  if half > 0 && evenZeros * 10 > half * 3 && oddZeros * 10 < half {
+    return "UTF-16BE"
+  }
+  // Don't let a multi-byte character cut off by the sample size count against UTF-8.
+  for i := 1; i <= 3 && i <= len(data); i++ {
+    if utf8.RuneStart(data[len(data) - i]) {
+      if !utf8.FullRune(data[len(data) - i:]) {
+        data = data[:len(data) - i]
+      }
+      break
+    }
+  }
+  if utf8.Valid(data) {
+    return "UTF-8"
+  }
+  return "ISO-8859-1"
+}
+
+/*
+ * Read a text file and decode it to a string.
+ * @param filePath the file to read
+ * @param encoding the file's encoding (see DetectEncoding()), or "" to detect it
+ * @returns the decoded text or an error
+ *
+ * Byte order marks are stripped. Supported encodings are "UTF-8", "UTF-16LE",
+ * "UTF-16BE", and "ISO-8859-1" (also accepted as "Latin-1").
+ */
+func ReadTextFileAs(filePath string, encoding string) (string, error) {
+  data, err := ioutil.ReadFile(filePath)
+  if err != nil {
+    return "", err
+  }
+  if encoding == "" {
+    encoding = detectEncoding(data)
+  }
+  switch strings.ToUpper(encoding) {
+  case "UTF-8", "UTF8":
+    if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+      data = data[3:]
+    }
+    return string(data), nil
+  case "UTF-16LE", "UTF-16BE":
+    bigEndian := strings.ToUpper(encoding) == "UTF-16BE"
+    if len(data) >= 2 && ((bigEndian && data[0] == 0xFE && data[1] == 0xFF) || (!bigEndian && data[0] == 0xFF && data[1] == 0xFE)) {
+      data = data[2:]
+    }
+    units := make([]uint16, len(data) / 2)
+    for i := range units {
+      if bigEndian {
+        units[i] = uint16(data[2 * i]) << 8 | uint16(data[2 * i + 1])
+      } else {
+        units[i] = uint16(data[2 * i + 1]) << 8 | uint16(data[2 * i])
+      }
+    }
+    return string(utf16.Decode(units)), nil
+  case "ISO-8859-1", "LATIN-1", "LATIN1":
+    runes := make([]rune, len(data))
+    for i, b := range data {
+      runes[i] = rune(b)
+    }
+    return string(runes), nil
+  }
+  return "", fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+/*
+ * Extract only the files of a zip whose names match a glob pattern.
+ * @param zipFilePath the zip file to extract from
+ * @param destPath the directory to extract into (created if missing)
+ * @param pattern a slash-separated glob matched against each entry's full name, e.g. "**" + "/*.json"
+ * @returns the paths of the extracted files, or an error
+ *
+ * Each segment of the pattern is matched with path.Match(), so "*" doesn't cross
+ * a slash, and a "**" segment matches zero or more directories (as in
+ * ChildrenOfDirIgnoring()). Directory entries are never extracted themselves;
+ * the parents of extracted files are created as needed.
+ */
+func UnzipMatching(zipFilePath string, destPath string, pattern string) ([]string, error) {
+  if _, err := path.Match(pattern, ""); err != nil {
+    return nil, err
+  }
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  err = os.MkdirAll(destPath, 0755)
+  if err != nil {
+    return nil, err
+  }
+  patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+  extracted := []string{}
+  for _, f := range r.File {
+    if f.FileInfo().IsDir() || !matchSegments(patternSegments, strings.Split(strings.Trim(f.Name, "/"), "/")) {
+      continue
+    }
+    filePath, err := zipEntryPath(destPath, f.Name)
+    if err != nil {
+      return extracted, err
+    }
+    err = extractZipEntry(f, filePath)
+    if err != nil {
+      return extracted, err
+    }
+    extracted = append(extracted, filePath)
+  }
+  return extracted, nil
+}
+
+/*
+ * List the entries of a zip that Unzip() would refuse to extract to a directory
+ * because their names escape it (e.g. "../../etc/passwd"), without extracting anything.
+ * @param zipFilePath the zip file to check
+ * @param destPath the directory the zip would be extracted to
+ * @returns the names of the offending entries, in archive order, or an error
+ *
+ * This uses the same check as Unzip(), so an empty result means extraction
+ * won't fail with "illegal file path".
+ */
+func FindUnsafeEntries(zipFilePath string, destPath string) ([]string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  unsafe := []string{}
+  for _, f := range r.File {
+    if _, err := zipEntryPath(destPath, f.Name); err != nil {
+      unsafe = append(unsafe, f.Name)
+    }
+  }
+  return unsafe, nil
+}
+
+/*
+ * Finish or repair an extraction of a zip file.
+ * @param zipFilePath the zip file to extract
+ * @param destPath the directory the zip file was (perhaps partially) extracted to
+ * @returns the paths of the files that were (re)written, or an error
+ *
+ * Entries whose file already exists with the right size and CRC-32 (taken from
+ * the zip's central directory, so the archive itself isn't decompressed) are skipped.
+ * This makes extraction idempotent: running it again after an interruption only
+ * extracts what is missing or corrupt.
+ */
+func SyncZipToDir(zipFilePath string, destPath string) ([]string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  err = os.MkdirAll(destPath, 0755)
+  if err != nil {
+    return nil, err
+  }
+  written := []string{}
+  for _, f := range r.File {
+    filePath, err := zipEntryPath(destPath, f.Name)
+    if err != nil {
+      return written, err
+    }
+    if !f.FileInfo().IsDir() {
+      matches, err := fileMatchesZipEntry(filePath, f)
+      if err != nil {
+        return written, err
+      }
+      if matches {
+        continue
+      }
+    }
+    err = extractZipEntry(f, filePath)
+    if err != nil {
+      return written, err
+    }
+    if !f.FileInfo().IsDir() {
+      written = append(written, filePath)
+    }
+  }
+  return written, nil
+}
+
+/*
+ * Options for DiffZipAgainstDirWithOptions().
+ */
+type ZipDiffOptions struct {
+  // If set, filled with the files (as slash-separated paths relative to dirPath)
+  // that exist on disk but aren't in the zip, i.e. what extracting wouldn't touch.
+  OnlyOnDisk *[]string
+}
+
+/*
+ * Preview what extracting a zip file over a directory would change.
+ * @param zipFilePath the zip file
+ * @param dirPath the directory it would be extracted to
+ * @returns the zip's file entry names that are missing on disk, that differ from disk, and that match disk, and an error
+ *
+ * Same as DiffZipAgainstDirWithOptions() with the default options.
+ */
+func DiffZipAgainstDir(zipFilePath string, dirPath string) ([]string, []string, []string, error) {
+  return DiffZipAgainstDirWithOptions(zipFilePath, dirPath, ZipDiffOptions{})
+}
+
+/*
+ * Preview what extracting a zip file over a directory would change.
+ * @param zipFilePath the zip file
+ * @param dirPath the directory it would be extracted to
+ * @param options what else to report
+ * @returns the zip's file entry names that are missing on disk, that differ from disk, and that match disk, and an error
+ *
+ * Files are compared like SyncZipToDir() compares them: by size, then by CRC-32
+ * against the zip's central directory, so the archive isn't decompressed and
+ * files of the wrong size aren't even read. A directory on disk where the zip
+ * has a file counts as differing. Directory entries aren't reported. Entries
+ * that would escape dirPath are an error, as they are when extracting.
+ */
+func DiffZipAgainstDirWithOptions(zipFilePath string, dirPath string, options ZipDiffOptions) ([]string, []string, []string, error) {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  defer r.Close()
+  toAdd := []string{}
+  toUpdate := []string{}
+  unchanged := []string{}
+  inZip := map[string]bool{}
+  for _, f := range r.File {
+    filePath, err := zipEntryPath(dirPath, f.Name)
+    if err != nil {
+      return nil, nil, nil, err
+    }
+    inZip[filePath] = true
+    if f.FileInfo().IsDir() {
+      continue
+    }
+    _, err = os.Lstat(filePath)
+    if os.IsNotExist(err) {
+      toAdd = append(toAdd, f.Name)
+      continue
+    }
+    if err != nil {
+      return nil, nil, nil, err
+    }
+    matches, err := fileMatchesZipEntry(filePath, f)
+    if err != nil {
+      return nil, nil, nil, err
+    }
+    if matches {
+      unchanged = append(unchanged, f.Name)
+    } else {
+      toUpdate = append(toUpdate, f.Name)
+    }
+  }
+  if options.OnlyOnDisk != nil {
+    onlyOnDisk := []string{}
+    err = filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+      if err != nil {
+        if os.IsNotExist(err) && filePath == dirPath {
+          return nil
+        }
+        return err
+      }
+      if !info.IsDir() && !inZip[filePath] {
+        relPath, err := filepath.Rel(dirPath, filePath)
+        if err != nil {
+          return err
+        }
+        onlyOnDisk = append(onlyOnDisk, filepath.ToSlash(relPath))
+      }
+      return nil
+    })
+    if err != nil {
+      return nil, nil, nil, err
+    }
+    *options.OnlyOnDisk = onlyOnDisk
+  }
+  return toAdd, toUpdate, unchanged, nil
+}
+
+func fileMatchesZipEntry(filePath string, f *zip.File) (bool, error) {
+  info, err := os.Stat(filePath)
+  if os.IsNotExist(err) {
+    return false, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  if info.IsDir() || uint64(info.Size()) != f.UncompressedSize64 {
+    return false, nil
+  }
+  file, err := os.Open(filePath)
+  if err != nil {
+    return false, err
+  }
+  defer file.Close()
+  hasher := crc32.NewIEEE()
+  _, err = io.Copy(hasher, file)
+  if err != nil {
+    return false, err
+  }
+  return hasher.Sum32() == f.CRC32, nil
+}
+
+// Joins a zip entry's name onto the destination, rejecting names that escape it (ZipSlip).
+func zipEntryPath(destinationPath string, name string) (string, error) {
+  path := filepath.Join(destinationPath, name)
+  if !strings.HasPrefix(path, filepath.Clean(destinationPath) + string(os.PathSeparator)) {
+    return "", fmt.Errorf("illegal file path: %s", path)
+  }
+  return path, nil
+}
+
+// Writes a single zip entry (a file or a directory) to the given path.
+func extractZipEntry(f *zip.File, path string) error {
+  return extractZipEntryWithProgress(f, path, nil)
+}
+
+// Like extractZipEntry(), but calls progress (if non-nil) with the bytes written so far as it goes.
+func extractZipEntryWithProgress(f *zip.File, path string, progress func(done int64)) error {
+  if f.FileInfo().IsDir() {
+    return os.MkdirAll(path, 0755)
+  }
+  err := os.MkdirAll(filepath.Dir(path), 0755)
+  if err != nil {
+    return err
+  }
+  release, _ := acquireIO(context.Background())
+  defer release()
+  rc, err := f.Open()
+  if err != nil {
+    return err
+  }
+  defer rc.Close()
+  file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+  if err != nil {
+    return err
+  }
+  var w io.Writer = file
+  if progress != nil {
+    w = &progressWriter{w: file, progress: progress}
+  }
+  _, err = io.Copy(w, rc)
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  return wrapDiskFull(path, err)
+}
+
+// Reports its running total to a callback, at most once per progressInterval bytes.
+type progressWriter struct {
+  w io.Writer
+  progress func(done int64)
+  done int64
+  reported int64
+}
+
+const progressInterval = 1 << 20
+
+func (writer *progressWriter) Write(data []byte) (int, error) {
+  n, err := writer.w.Write(data)
+  writer.done += int64(n)
+  if writer.done - writer.reported >= progressInterval {
+    writer.reported = writer.done
+    writer.progress(writer.done)
+  }
+  return n, err
+}
+
+/*
+ * Unzip a zip file, reporting progress along the way, e.g. for a progress bar.
+ * @param zipFilePath the zip file to extract
+ * @param destPath the directory to extract into (created if missing)
+ * @param onEntry called with the current entry's name, its index and the number of entries,
+ *   and the bytes extracted so far of the entry's uncompressed size
+ * @returns an error
+ *
+ * onEntry is called when each entry starts (with bytesDone 0) and finishes (with
+ * bytesDone equal to bytesTotal), and in between about every megabyte for large entries.
+ * Entries are checked for ZipSlip as in Unzip().
+ */
+func UnzipWithProgress(zipFilePath string, destPath string, onEntry func(name string, index, total int, bytesDone, bytesTotal int64)) error {
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+  err = os.MkdirAll(destPath, 0755)
+  if err != nil {
+    return err
+  }
+  total := len(r.File)
+  for index, f := range r.File {
+    filePath, err := zipEntryPath(destPath, f.Name)
+    if err != nil {
+      return err
+    }
+    bytesTotal := int64(f.UncompressedSize64)
+    onEntry(f.Name, index, total, 0, bytesTotal)
+    err = extractZipEntryWithProgress(f, filePath, func(done int64) {
+      if done < bytesTotal {
+        onEntry(f.Name, index, total, done, bytesTotal)
+      }
+    })
+    if err != nil {
+      return err
+    }
+    onEntry(f.Name, index, total, bytesTotal, bytesTotal)
+  }
+  return nil
+}
+
+var ErrAlreadyExists = errors.New("File already exists")
+
+/*
+ * Create a file and write data to it, but only if nothing exists at the path yet.
+ * @param filePath the file to create
+ * @param data the contents of the new file
+ * @param perm the permissions of the new file
+ * @returns ErrAlreadyExists if an entity already exists at filePath, or another error
+ *
+ * The existence check and the creation happen atomically (O_CREATE|O_EXCL), so
+ * this is safe to use for lock and marker files. If writing the data fails,
+ * the new file is removed.
+ */
+func CreateExclusive(filePath string, data []byte, perm os.FileMode) error {
+  file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+  if os.IsExist(err) {
+    return ErrAlreadyExists
+  }
+  if err != nil {
+    return err
+  }
+  _, err = file.Write(data)
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(filePath)
+    return err
+  }
+  return nil
+}
+
+/*
+ * Same as CreateExclusive(), but first creates any missing parent directories.
+ */
+func CreateExclusiveAll(filePath string, data []byte, perm os.FileMode) error {
+  err := os.MkdirAll(filepath.Dir(filePath), 0755)
+  if err != nil {
+    return err
+  }
+  return CreateExclusive(filePath, data, perm)
+}
+
+/*
+ * Create a file of the given size, reserving the disk space for it up front.
+ * @param filePath the file to create (an existing file is resized)
+ * @param size the size of the file in bytes
+ * @returns ErrDiskFull if there isn't room for the file, or another error
+ *
+ * On Linux this uses fallocate(), which reserves real (and usually contiguous)
+ * blocks without writing zeros, so running out of space is reported here
+ * rather than part way through filling the file.
+ * Elsewhere, and on Linux filesystems without fallocate() support, the file is
+ * only extended with Truncate(). That's fast, but on most filesystems it makes
+ * a sparse file, so no space is actually reserved.
+ * Either way, the new bytes read as zeros.
+ */
+func AllocateFile(filePath string, size int64) error {
+  file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  err = allocateFile(file, size)
+  if err != nil {
+    file.Close()
+    return wrapDiskFull(filePath, err)
+  }
+  return file.Close()
+}
+
+/*
+ * An append-only file (e.g. a log) that rotates itself once it grows too large.
+ *
+ * When a Write() would push the file past maxBytes, the file is renamed to
+ * "path.1", the existing "path.1" to "path.2", and so on, and a fresh file is started.
+ * Backups beyond "path.<maxBackups>" are deleted. A single Write() is never
+ * split across files, so a write larger than maxBytes gets a file to itself.
+ * If a rotation fails (e.g. a backup can't be renamed), the write is appended to
+ * the current file anyway and the rotation is retried on the next Write(), so the
+ * file can grow past maxBytes until the problem is fixed; RotationError() reports it.
+ * A RotatingFile is safe to use from multiple goroutines, but not from multiple processes.
+ */
+type RotatingFile struct {
+  filePath string
+  maxBytes int64
+  maxBackups int
+  lock sync.Mutex
+  file *os.File
+  size int64
+  closed bool
+  rotationErr error
+}
+
+func NewRotatingFile(filePath string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+  rotatingFile := &RotatingFile{filePath: filePath, maxBytes: maxBytes, maxBackups: maxBackups}
+  err := rotatingFile.open()
+  if err != nil {
+    return nil, err
+  }
+  return rotatingFile, nil
+}
+
+func (rotatingFile *RotatingFile) open() error {
+  file, err := os.OpenFile(rotatingFile.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+  info, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return err
+  }
+  rotatingFile.file = file
+  rotatingFile.size = info.Size()
+  return nil
+}
+
+// Closes the current file, shifts the backups along, and starts a fresh file.
+// If any step fails, the current path is reopened for appending before the error
+// is returned, so the caller can still write to it.
+func (rotatingFile *RotatingFile) rotate() error {
+  err := rotatingFile.file.Close()
+  rotatingFile.file = nil
+  if err == nil {
+    err = rotatingFile.shiftBackups()
+  }
+  if err != nil {
+    rotatingFile.open()
+    return err
+  }
+  return rotatingFile.open()
+}
+
+func (rotatingFile *RotatingFile) shiftBackups() error {
+  backup := func(i int) string { return fmt.Sprintf("%s.%d", rotatingFile.filePath, i) }
+  var err error
+  if rotatingFile.maxBackups <= 0 {
+    err = os.Remove(rotatingFile.filePath)
+  } else {
+    err = os.Remove(backup(rotatingFile.maxBackups))
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    for i := rotatingFile.maxBackups - 1; i >= 1; i-- {
+      err = os.Rename(backup(i), backup(i + 1))
+      if err != nil && !os.IsNotExist(err) {
+        return err
+      }
+    }
+    err = os.Rename(rotatingFile.filePath, backup(1))
+  }
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
+func (rotatingFile *RotatingFile) Write(data []byte) (int, error) {
+  rotatingFile.lock.Lock()
+  defer rotatingFile.lock.Unlock()
+  if rotatingFile.closed {
+    return 0, os.ErrClosed
+  }
+  if rotatingFile.file == nil {
+    // A previous rotation couldn't reopen the file; try again.
+    err := rotatingFile.open()
+    if err != nil {
+      return 0, err
+    }
+  }
+  if rotatingFile.size > 0 && rotatingFile.size + int64(len(data)) > rotatingFile.maxBytes {
+    rotatingFile.rotationErr = rotatingFile.rotate()
+    if rotatingFile.file == nil {
+      return 0, rotatingFile.rotationErr
+    }
+  }
+  n, err := rotatingFile.file.Write(data)
+  rotatingFile.size += int64(n)
+  return n, err
+}
+
+/*
+ * @returns why the most recent rotation failed, or nil if it succeeded (or none has been needed)
+ *
+ * A failed rotation doesn't fail the Write() that triggered it, so check this
+ * to notice that the file is growing past its limit.
+ */
+func (rotatingFile *RotatingFile) RotationError() error {
+  rotatingFile.lock.Lock()
+  defer rotatingFile.lock.Unlock()
+  return rotatingFile.rotationErr
+}
+
+func (rotatingFile *RotatingFile) Close() error {
+  rotatingFile.lock.Lock()
+  defer rotatingFile.lock.Unlock()
+  if rotatingFile.closed {
+    return os.ErrClosed
+  }
+  rotatingFile.closed = true
+  if rotatingFile.file == nil {
+    return nil
+  }
+  err := rotatingFile.file.Close()
+  rotatingFile.file = nil
+  return err
+}
+
+/*
+ * Returned by IsSolidState() when the kind of disk can't be determined.
+ * The answer is only ever a hint for tuning (e.g. how many files to copy in parallel),
+ * so callers should pick a middle-of-the-road default when they see this.
+ */
+var ErrSolidStateUnknown = errors.New("Unknown whether the disk is solid state")
+
+/*
+ * Returned by IsFileInUse() on platforms where there's no way to tell.
+ */
+var ErrInUseUnknown = errors.New("Unknown whether the file is in use")
+
+/*
+ * Write a file by writing a temporary file next to it and renaming it into place,
+ * so readers see either the old contents or the new ones, never a partial file.
+ * If write returns an error, the temporary file is removed and filePath is untouched.
+ */
+func writeFileAtomic(filePath string, perm os.FileMode, write func(file *os.File) error) error {
+  temp, err := ioutil.TempFile(filepath.Dir(filePath), "." + filepath.Base(filePath) + ".tmp*")
+  if err != nil {
+    return err
+  }
+  err = write(temp)
+  if err == nil {
+    err = temp.Sync()
+  }
+  if closeErr := temp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Chmod(temp.Name(), perm)
+  }
+  if err == nil {
+    err = os.Rename(temp.Name(), filePath)
+  }
+  if err != nil {
+    os.Remove(temp.Name())
+  }
+  return err
+}
+
+/*
+ * A step in a ProcessFile() pipeline. It receives the input a chunk at a time
+ * and returns the bytes to pass on, which may be longer or shorter than the chunk.
+ * At the end of the input it is called once more with a nil chunk, so it can
+ * return anything it was holding on to.
+ * The chunk is only valid during the call, since ProcessFile() reuses its read
+ * buffer, so a transform that holds on to bytes must copy them (as LineTransform() does).
+ * Returning the chunk itself, or a slice of it, is fine.
+ */
+type ByteTransform func(chunk []byte) ([]byte, error)
+
+/*
+ * Stream a file through a series of transforms and write the result to another file.
+ * @param inPath the file to read
+ * @param outPath the file to write; it is replaced atomically once every transform succeeds
+ * @param transforms the steps to apply, in order
+ * @returns an error
+ *
+ * Chunks are split at arbitrary points. To work on whole lines, wrap a function with LineTransform().
+ */
+func ProcessFile(inPath string, outPath string, transforms ...ByteTransform) error {
+  inFile, err := os.Open(inPath)
+  if err != nil {
+    return err
+  }
+  defer inFile.Close()
+  info, err := inFile.Stat()
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(outPath, info.Mode().Perm(), func(outFile *os.File) error {
+    writer := bufio.NewWriter(outFile)
+    // Passes a chunk through transforms[start:] and writes what comes out.
+    var run func(chunk []byte, start int) error
+    run = func(chunk []byte, start int) error {
+      for _, transform := range transforms[start:] {
+        if len(chunk) == 0 {
+          return nil
+        }
+        var err error
+        chunk, err = transform(chunk)
+        if err != nil {
+          return err
+        }
+      }
+      _, err := writer.Write(chunk)
+      return err
+    }
+    buffer := make([]byte, 32 * 1024)
+    for {
+      n, err := inFile.Read(buffer)
+      if n > 0 {
+        runErr := run(buffer[:n], 0)
+        if runErr != nil {
+          return runErr
+        }
+      }
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        return err
+      }
+    }
+    for i, transform := range transforms {
+      rest, err := transform(nil)
+      if err != nil {
+        return err
+      }
+      err = run(rest, i + 1)
+      if err != nil {
+        return err
+      }
+    }
+    return writer.Flush()
+  })
+}
+
+/*
+ * Adapt a function that works on whole lines into a ByteTransform.
+ * @param transform called once per line, including the line's "\n" (the last line may not have one)
+ * @returns a ByteTransform for ProcessFile()
+ */
+func LineTransform(transform func(line []byte) ([]byte, error)) ByteTransform {
+  pending := []byte{}
+  return func(chunk []byte) ([]byte, error) {
+    if chunk == nil {
+      if len(pending) == 0 {
+        return nil, nil
+      }
+      line := pending
+      pending = []byte{}
+      return transform(line)
+    }
+    pending = append(pending, chunk...)
+    out := []byte{}
+    for {
+      i := bytes.IndexByte(pending, '\n')
+      if i < 0 {
+        break
+      }
+      line, err := transform(pending[:i + 1])
+      if err != nil {
+        return nil, err
+      }
+      out = append(out, line...)
+      pending = pending[i + 1:]
+    }
+    // Don't keep the consumed lines' backing array alive.
+    pending = append([]byte{}, pending...)
+    return out, nil
+  }
+}
+
+/*
+ * Concatenate files into a new file.
+ * @param outPath the file to write
+ * @param inPaths the files to concatenate, in order
+ * @returns an error
+ *
+ * Equivalent to ConcatFilesWithSeparator(outPath, nil, inPaths...).
+ */
+func ConcatFiles(outPath string, inPaths ...string) error {
+  return ConcatFilesWithSeparator(outPath, nil, inPaths...)
+}
+
+/*
+ * Concatenate files into a new file, with a separator between each pair.
+ * @param outPath the file to write
+ * @param separator the bytes to write between files (e.g. "\n"), or nil
+ * @param inPaths the files to concatenate, in order
+ * @returns an error
+ *
+ * The output is written atomically, so if any input is missing or unreadable,
+ * outPath is left untouched.
+ */
+func ConcatFilesWithSeparator(outPath string, separator []byte, inPaths ...string) error {
+  for _, inPath := range inPaths {
+    _, err := os.Stat(inPath)
+    if err != nil {
+      return err
+    }
+  }
+  return writeFileAtomic(outPath, 0644, func(outFile *os.File) error {
+    for i, inPath := range inPaths {
+      if i > 0 && len(separator) > 0 {
+        _, err := outFile.Write(separator)
+        if err != nil {
+          return err
+        }
+      }
+      inFile, err := os.Open(inPath)
+      if err != nil {
+        return err
+      }
+      _, err = io.Copy(outFile, inFile)
+      inFile.Close()
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+type dirManifestEntry struct {
+  Path string
+  Mode os.FileMode
+  ModTime time.Time
+  Size int64
+  // Only recorded on Unix.
+  Uid *int `json:",omitempty"`
+  Gid *int `json:",omitempty"`
+}
+
+/*
+ * Record the metadata of everything in a directory, for RestoreDirMetadata().
+ * @param dirPath the directory to describe
+ * @param manifestPath the JSON file to write
+ * @returns an error
+ *
+ * Each entry's relative path, mode, modification time, size, and (on Unix) owner are recorded.
+ */
+func SaveDirManifest(dirPath string, manifestPath string) error {
+  entries := []dirManifestEntry{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil {
+      return err
+    }
+    entry := dirManifestEntry{Path: filepath.ToSlash(relPath), Mode: info.Mode(), ModTime: info.ModTime(), Size: info.Size()}
+    if uid, gid, ok := fileOwner(info); ok {
+      entry.Uid = &uid
+      entry.Gid = &gid
+    }
+    entries = append(entries, entry)
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  data, err := json.MarshalIndent(entries, "", "  ")
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(manifestPath, 0644, func(file *os.File) error {
+    _, err := file.Write(data)
+    return err
+  })
+}
+
+/*
+ * Returned by RestoreDirMetadata() when some entries in the manifest no longer exist.
+ * Everything else was still restored.
+ */
+type MissingEntriesError struct {
+  Paths []string
+}
+
+func (err *MissingEntriesError) Error() string {
+  return fmt.Sprintf("%d entries in the manifest no longer exist: %s", len(err.Paths), strings.Join(err.Paths, ", "))
+}
+
+/*
+ * Reapply the metadata recorded by SaveDirManifest(), e.g. after a copy that didn't preserve it.
+ * @param dirPath the directory to restore
+ * @param manifestPath the JSON file written by SaveDirManifest()
+ * @returns a *MissingEntriesError if some entries no longer exist, or another error
+ *
+ * Permissions and modification times are restored (not for symlinks, whose
+ * targets would be changed instead). Ownership is restored where the platform
+ * and the process's privileges allow it (usually only as root); failures to
+ * change ownership are ignored.
+ * Since this is often run as root, the manifest isn't trusted: if any entry's
+ * path is absolute or climbs out of dirPath, nothing is restored and the error
+ * wraps ErrEscapesRoot. An entry reached through a symlinked directory (which
+ * SaveDirManifest() never records) is the same error, though entries after it
+ * in the manifest will already have been restored.
+ */
+func RestoreDirMetadata(dirPath string, manifestPath string) error {
+  data, err := ioutil.ReadFile(manifestPath)
+  if err != nil {
+    return err
+  }
+  entries := []dirManifestEntry{}
+  err = json.Unmarshal(data, &entries)
+  if err != nil {
+    return err
+  }
+  for _, entry := range entries {
+    cleaned := filepath.Clean(filepath.FromSlash(entry.Path))
+    if filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" || cleaned == ".." || strings.HasPrefix(cleaned, ".." + string(os.PathSeparator)) {
+      return fmt.Errorf("%w: %s", ErrEscapesRoot, entry.Path)
+    }
+  }
+  missing := []string{}
+  // Children come after their parents in the manifest, so go backwards to set a
+  // directory's times after anything that might touch them.
+  for i := len(entries) - 1; i >= 0; i-- {
+    entry := entries[i]
+    filePath, err := manifestEntryPath(dirPath, entry.Path)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    var info os.FileInfo
+    if err == nil {
+      info, err = os.Lstat(filePath)
+    }
+    if os.IsNotExist(err) {
+      missing = append([]string{entry.Path}, missing...)
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    if entry.Uid != nil && entry.Gid != nil {
+      os.Lchown(filePath, *entry.Uid, *entry.Gid)
+    }
+    if info.Mode() & os.ModeSymlink != 0 {
+      continue
+    }
+    err = os.Chmod(filePath, entry.Mode)
+    if err != nil {
+      return err
+    }
+    err = os.Chtimes(filePath, entry.ModTime, entry.ModTime)
+    if err != nil {
+      return err
+    }
+  }
+  if len(missing) > 0 {
+    return &MissingEntriesError{missing}
+  }
+  return nil
+}
+
+// Joins an already-checked manifest path onto dirPath, refusing to go through a
+// symlinked directory (which could lead anywhere).
+func manifestEntryPath(dirPath string, relPath string) (string, error) {
+  segments := strings.Split(filepath.Clean(filepath.FromSlash(relPath)), string(os.PathSeparator))
+  parent := dirPath
+  for _, segment := range segments[:len(segments) - 1] {
+    parent = filepath.Join(parent, segment)
+    info, err := os.Lstat(parent)
+    if err != nil {
+      return "", err
+    }
+    if info.Mode() & os.ModeSymlink != 0 {
+      return "", fmt.Errorf("%w: %s is reached through the symlink %s", ErrEscapesRoot, relPath, parent)
+    }
+  }
+  return filepath.Join(dirPath, filepath.FromSlash(relPath)), nil
+}
+
+var ErrMemberNotFound = errors.New("Member not found in archive")
+
+/*
+ * Read a single file out of a .tar.gz archive.
+ * @param archivePath the archive to read
+ * @param memberName the file's path within the archive (a leading "./" is optional)
+ * @returns the file's contents, or ErrMemberNotFound, or another error
+ *
+ * The archive is only read up to the member, so files near the start of a large archive are quick to get.
+ */
+func ReadTarGzMember(archivePath string, memberName string) ([]byte, error) {
+  var data []byte
+  err := findTarGzMember(archivePath, memberName, func(reader io.Reader, header *tar.Header) error {
+    var err error
+    data, err = ioutil.ReadAll(reader)
+    return err
+  })
+  return data, err
+}
+
+/*
+ * Extract a single file out of a .tar.gz archive.
+ * @param archivePath the archive to read
+ * @param memberName the file's path within the archive (a leading "./" is optional)
+ * @param destPath where to write the file
+ * @returns ErrMemberNotFound, or another error
+ */
+func ExtractTarGzMember(archivePath string, memberName string, destPath string) error {
+  return findTarGzMember(archivePath, memberName, func(reader io.Reader, header *tar.Header) error {
+    file, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+    if err != nil {
+      return err
+    }
+    _, err = io.Copy(file, reader)
+    if closeErr := file.Close(); err == nil {
+      err = closeErr
+    }
+    return err
+  })
+}
+
+// Streams through a .tar.gz archive until it finds the named regular file, then calls fn with its contents.
+func findTarGzMember(archivePath string, memberName string, fn func(reader io.Reader, header *tar.Header) error) error {
+  file, err := os.Open(archivePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  gzipReader, err := gzip.NewReader(file)
+  if err != nil {
+    return err
+  }
+  defer gzipReader.Close()
+  tarReader := tar.NewReader(gzipReader)
+  memberName = path.Clean(memberName)
+  for {
+    header, err := tarReader.Next()
+    if err == io.EOF {
+      return ErrMemberNotFound
+    }
+    if err != nil {
+      return err
+    }
+    if header.Typeflag == tar.TypeReg && path.Clean(header.Name) == memberName {
+      return fn(tarReader, header)
+    }
+  }
+}
+
+/*
+ * Options for UntarGzWithOptions(). The zero value behaves like UntarGz().
+ */
+type UntarOptions struct {
+  // Create character devices, block devices, and FIFOs instead of failing on them.
+  // Devices can only be made by root, and only on Linux.
+  AllowDevices bool
+  // Remove this many leading path segments from each entry's name (and from hard
+  // link targets), like tar's --strip-components. Entries with no segments left
+  // are skipped; a hard link whose target has none left is an error.
+  StripComponents int
+  // If positive, fail with a *PathLimitError when an entry has more path segments
+  // than this ("a/b/c.txt" has 3), counted after StripComponents. Unlike
+  // UnzipWithOptions(), the archive is streamed, so entries before it are
+  // already extracted.
+  MaxDepth int
+}
+
+/*
+ * Extract a .tar.gz archive.
+ * @param archivePath the archive to extract
+ * @param destPath the directory to extract into (created if missing)
+ * @returns an error
+ *
+ * Same as UntarGzWithOptions() with the default options.
+ */
+func UntarGz(archivePath string, destPath string) error {
+  return UntarGzWithOptions(archivePath, destPath, UntarOptions{})
+}
+
+/*
+ * Extract a .tar.gz archive.
+ * @param archivePath the archive to extract
+ * @param destPath the directory to extract into (created if missing)
+ * @param options how to extract
+ * @returns an error
+ *
+ * Files, directories, symlinks, and hard links are recreated with their permission
+ * bits. A hard link may come before the file it links to; it's made once the
+ * rest of the archive is extracted. Entries (and hard links) whose paths escape
+ * destPath are rejected, and so are absolute symlinks and symlinks that point
+ * outside it, including through other symlinks in the archive: every path is
+ * resolved one component at a time against what's actually on disk, and the
+ * symlinks are checked again once everything is extracted, in case a later
+ * entry changed where one leads. Only directories this call created have their
+ * permissions set. Devices and FIFOs are an error unless allowed by the options.
+ * Owners and timestamps aren't restored.
+ */
+func UntarGzWithOptions(archivePath string, destPath string, options UntarOptions) error {
+  file, err := os.Open(archivePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  gzipReader, err := gzip.NewReader(file)
+  if err != nil {
+    return err
+  }
+  defer gzipReader.Close()
+  err = os.MkdirAll(destPath, 0755)
+  if err != nil {
+    return err
+  }
+  realDest, err := filepath.EvalSymlinks(destPath)
+  if err != nil {
+    return err
+  }
+  realDest, err = filepath.Abs(realDest)
+  if err != nil {
+    return err
+  }
+  tarReader := tar.NewReader(gzipReader)
+  dirModes := map[string]os.FileMode{}
+  dirOrder := []string{}
+  created := map[string]bool{}
+  symlinks := []extractedSymlink{}
+  // Hard links whose targets hadn't been extracted yet: link path -> target path.
+  pendingLinks := [][2]string{}
+  for {
+    header, err := tarReader.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+    name := header.Name
+    linkname := header.Linkname
+    if options.StripComponents > 0 {
+      var ok bool
+      name, ok = stripComponents(name, options.StripComponents)
+      if !ok {
+        continue
+      }
+      if header.Typeflag == tar.TypeLink {
+        linkname, ok = stripComponents(linkname, options.StripComponents)
+        if !ok {
+          return fmt.Errorf("hard link target was stripped away: %s -> %s", header.Name, header.Linkname)
+        }
+      }
+    }
+    if path.Clean(strings.TrimPrefix(name, "/")) == "." {
+      continue
+    }
+    entryPath, err := zipEntryPath(realDest, name)
+    if err != nil {
+      return err
+    }
+    if options.MaxDepth > 0 {
+      depth := len(strings.Split(strings.Trim(entryPath[len(realDest) + 1:], string(os.PathSeparator)), string(os.PathSeparator)))
+      if depth > options.MaxDepth {
+        return &PathLimitError{header.Name, fmt.Sprintf("is nested %d levels deep, more than the limit of %d", depth, options.MaxDepth)}
+      }
+    }
+    mode := os.FileMode(header.Mode).Perm()
+    if header.Typeflag == tar.TypeDir {
+      realPath, err := mkdirWithin(realDest, entryPath, created)
+      if err != nil {
+        return err
+      }
+      if _, seen := dirModes[realPath]; !seen {
+        dirOrder = append(dirOrder, realPath)
+      }
+      dirModes[realPath] = mode
+      continue
+    }
+    parent, err := untarParent(realDest, entryPath, created)
+    if err != nil {
+      return err
+    }
+    entryPath = filepath.Join(parent, filepath.Base(entryPath))
+    // Replace whatever is there, so we never write through an existing symlink.
+    err = os.Remove(entryPath)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    switch header.Typeflag {
+    case tar.TypeReg, tar.TypeRegA:
+      out, err := os.OpenFile(entryPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+      if err != nil {
+        return err
+      }
+      _, err = io.Copy(out, tarReader)
+      if closeErr := out.Close(); err == nil {
+        err = closeErr
+      }
+      if err != nil {
+        return wrapDiskFull(entryPath, err)
+      }
+    case tar.TypeSymlink:
+      target := filepath.FromSlash(header.Linkname)
+      if symlinkEscapes(realDest, parent, target) {
+        return fmt.Errorf("illegal symlink target: %s -> %s", header.Name, header.Linkname)
+      }
+      err = os.Symlink(target, entryPath)
+      if err != nil {
+        return err
+      }
+      symlinks = append(symlinks, extractedSymlink{entryPath, parent, target})
+    case tar.TypeLink:
+      target, err := zipEntryPath(realDest, linkname)
+      if err != nil {
+        return err
+      }
+      pendingLinks = append(pendingLinks, [2]string{entryPath, target})
+    case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+      if !options.AllowDevices {
+        return fmt.Errorf("refusing to extract device or FIFO %s", header.Name)
+      }
+      err = makeDevice(entryPath, header)
+      if err != nil {
+        return err
+      }
+    default:
+      return fmt.Errorf("unsupported tar entry type %q for %s", header.Typeflag, header.Name)
+    }
+  }
+  for _, link := range pendingLinks {
+    // The target must be a real entry inside the destination, not something reached through a symlink.
+    realTarget, err := filepath.EvalSymlinks(filepath.Dir(link[1]))
+    if err != nil {
+      return fmt.Errorf("hard link %s: %w", link[0], err)
+    }
+    if realTarget != realDest && !strings.HasPrefix(realTarget, realDest + string(os.PathSeparator)) {
+      return fmt.Errorf("illegal hard link target: %s", link[1])
+    }
+    parent, err := untarParent(realDest, link[0], created)
+    if err != nil {
+      return err
+    }
+    err = os.Link(filepath.Join(realTarget, filepath.Base(link[1])), filepath.Join(parent, filepath.Base(link[0])))
+    if err != nil {
+      return err
+    }
+  }
+  return finishExtraction(realDest, symlinks, dirOrder, dirModes, created)
+}
+
+// A symlink made while extracting, kept so it can be checked again at the end.
+type extractedSymlink struct {
+  path string
+  realDir string
+  target string
+}
+
+// Rechecks the extracted symlinks (removing any that now lead outside realDest),
+// then sets the modes of the directories that were created, deepest first so a
+// read-only parent doesn't block chmod-ing its children.
+func finishExtraction(realDest string, symlinks []extractedSymlink, dirOrder []string, dirModes map[string]os.FileMode, created map[string]bool) error {
+  for _, link := range symlinks {
+    info, err := os.Lstat(link.path)
+    if err != nil || info.Mode()&os.ModeSymlink == 0 {
+      // Replaced by a later entry.
+      continue
+    }
+    if symlinkEscapes(realDest, link.realDir, link.target) {
+      os.Remove(link.path)
+      return fmt.Errorf("illegal symlink target: %s -> %s", link.path, link.target)
+    }
+  }
+  for i := len(dirOrder) - 1; i >= 0; i-- {
+    dirPath := dirOrder[i]
+    // Never chmod through a symlink, or a directory that was already there.
+    info, err := os.Lstat(dirPath)
+    if err != nil || !info.IsDir() || !created[dirPath] {
+      continue
+    }
+    err = os.Chmod(dirPath, dirModes[dirPath])
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Creates the parent directory of an entry, returning its real path if it's still inside the destination.
+func untarParent(realDest string, entryPath string, created map[string]bool) (string, error) {
+  return mkdirWithin(realDest, filepath.Dir(entryPath), created)
+}
+
+// Reports whether path is realDest or inside it.
+func isWithin(realDest string, path string) bool {
+  return path == realDest || strings.HasPrefix(path, realDest + string(os.PathSeparator))
+}
+
+// Creates dirPath (which must be lexically inside realDest) one component at a
+// time, following only symlinks that resolve inside realDest, and returns its
+// real path. Unlike os.MkdirAll(), nothing is ever created outside realDest.
+// The real paths of the directories it makes are added to created, if non-nil.
+func mkdirWithin(realDest string, dirPath string, created map[string]bool) (string, error) {
+  relPath, err := filepath.Rel(realDest, dirPath)
+  if err != nil {
+    return "", err
+  }
+  current := realDest
+  if relPath == "." {
+    return current, nil
+  }
+  for _, component := range strings.Split(relPath, string(os.PathSeparator)) {
+    if component == ".." {
+      return "", fmt.Errorf("illegal file path: %s", dirPath)
+    }
+    next := filepath.Join(current, component)
+    info, err := os.Lstat(next)
+    switch {
+    case os.IsNotExist(err):
+      err = os.Mkdir(next, 0755)
+      if err != nil {
+        return "", err
+      }
+      if created != nil {
+        created[next] = true
+      }
+    case err != nil:
+      return "", err
+    case info.Mode()&os.ModeSymlink != 0:
+      next, err = filepath.EvalSymlinks(next)
+      if err != nil {
+        return "", err
+      }
+      if !isWithin(realDest, next) {
+        return "", fmt.Errorf("illegal file path (through a symlink): %s", dirPath)
+      }
+      info, err = os.Stat(next)
+      if err != nil {
+        return "", err
+      }
+      if !info.IsDir() {
+        return "", fmt.Errorf("%s is not a directory", next)
+      }
+    case !info.IsDir():
+      return "", fmt.Errorf("%s is not a directory", next)
+    }
+    current = next
+  }
+  return current, nil
+}
+
+// Reports whether a symlink in the (real) directory realLinkDir pointing at target
+// would lead outside realDest. The target is followed through what's on disk,
+// so ".." after a symlink climbs from wherever that symlink really goes; after a
+// component that doesn't exist yet (and so could later be created as a symlink),
+// ".." isn't allowed at all. Absolute targets always escape.
+func symlinkEscapes(realDest string, realLinkDir string, target string) bool {
+  if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+    return true
+  }
+  current := realLinkDir
+  missing := false
+  for _, component := range strings.Split(target, string(os.PathSeparator)) {
+    switch {
+    case component == "" || component == ".":
+      continue
+    case component == "..":
+      if missing {
+        return true
+      }
+      current = filepath.Dir(current)
+    case missing:
+      current = filepath.Join(current, component)
+    default:
+      next := filepath.Join(current, component)
+      info, err := os.Lstat(next)
+      switch {
+      case os.IsNotExist(err):
+        missing = true
+      case err != nil:
+        return true
+      case info.Mode()&os.ModeSymlink != 0:
+        next, err = filepath.EvalSymlinks(next)
+        if err != nil {
+          return true
+        }
+      }
+      current = next
+    }
+    if !isWithin(realDest, current) {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+ * Returned by write-heavy functions (CopyFile(), SaveRequestBodyAsFile(), Unzip(), ...)
+ * when the disk fills up, so callers can report it clearly and clean up Path.
+ */
+type ErrDiskFull struct {
+  // The file that was being written.
+  Path string
+  Err error
+}
+
+func (err *ErrDiskFull) Error() string {
+  return "Out of disk space while writing " + err.Path + ": " + err.Err.Error()
+}
+
+func (err *ErrDiskFull) Unwrap() error {
+  return err.Err
+}
+
+/*
+ * Checks whether an error means the disk is full (ENOSPC, or ERROR_DISK_FULL on Windows).
+ * @param err the error to check; wrapped errors are unwrapped
+ * @returns whether the error is a disk-full error
+ */
+func IsDiskFull(err error) bool {
+  var diskFull *ErrDiskFull
+  return errors.As(err, &diskFull) || isDiskFullErrno(err)
+}
+
+func wrapDiskFull(filePath string, err error) error {
+  if err != nil && isDiskFullErrno(err) {
+    return &ErrDiskFull{filePath, err}
+  }
+  return err
+}
+
+/*
+ * Write an inventory of a directory as newline-delimited JSON (one object per file).
+ * @param dirPath the directory to walk
+ * @param w where to write the inventory
+ * @returns an error
+ *
+ * Each line looks like:
+ *   {"path":"a/b.png","size":1234,"modTime":"2021-01-02T03:04:05Z","mode":"-rw-r--r--","contentType":"image/png"}
+ * where the content type is guessed with FileContentType(). Lines are written as
+ * the walk goes, so this works on trees of any size, e.g. piped into jq.
+ */
+func DumpDirNDJSON(dirPath string, w io.Writer) error {
+  encoder := json.NewEncoder(w)
+  return filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if !info.Mode().IsRegular() {
+      return nil
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil {
+      return err
+    }
+    contentType, err := FileContentType(filePath)
+    if err != nil {
+      return err
+    }
+    return encoder.Encode(struct {
+      Path string `json:"path"`
+      Size int64 `json:"size"`
+      ModTime time.Time `json:"modTime"`
+      Mode string `json:"mode"`
+      ContentType string `json:"contentType"`
+    }{filepath.ToSlash(relPath), info.Size(), info.ModTime(), info.Mode().String(), contentType})
+  })
+}
+
+/*
+ * Replace a directory with another one, e.g. to deploy a new build all at once.
+ * @param stagingDir the new directory; it is moved to liveDir
+ * @param liveDir the directory to replace; it need not exist yet
+ * @returns an error
+ *
+ * liveDir is renamed aside, stagingDir is renamed to liveDir, and then the old
+ * directory is deleted. Since only renames touch liveDir, readers see either the
+ * old tree or the new one, never a mix (though liveDir is briefly missing between
+ * the two renames). If the second rename fails, the old directory is put back.
+ * Renames are only atomic within one filesystem, so this fails up front if the
+ * two directories are on different filesystems (where the platform can tell).
+ */
+func SwapDir(stagingDir string, liveDir string) error {
+  stagingInfo, err := os.Stat(stagingDir)
+  if err != nil {
+    return err
+  }
+  if !stagingInfo.IsDir() {
+    return fmt.Errorf("%s is not a directory", stagingDir)
+  }
+  liveInfo, err := os.Stat(liveDir)
+  if os.IsNotExist(err) {
+    // Check against the directory liveDir will be created in instead.
+    liveInfo, err = os.Stat(filepath.Dir(filepath.Clean(liveDir)))
+    if err != nil {
+      return err
+    }
+    if !sameDevice(stagingInfo, liveInfo) {
+      return fmt.Errorf("%s and %s are on different filesystems, so they can't be swapped atomically", stagingDir, liveDir)
+    }
+    return os.Rename(stagingDir, liveDir)
+  }
+  if err != nil {
+    return err
+  }
+  if !sameDevice(stagingInfo, liveInfo) {
+    return fmt.Errorf("%s and %s are on different filesystems, so they can't be swapped atomically", stagingDir, liveDir)
+  }
+  oldDir := ""
+  for i := 0; oldDir == ""; i++ {
+    candidate := fmt.Sprintf("%s.old-%d-%d", filepath.Clean(liveDir), time.Now().UnixNano(), i)
+    _, err := os.Lstat(candidate)
+    if os.IsNotExist(err) {
+      oldDir = candidate
+    } else if err != nil {
+      return err
+    }
+  }
+  err = os.Rename(liveDir, oldDir)
+  if err != nil {
+    return err
+  }
+  err = os.Rename(stagingDir, liveDir)
+  if err != nil {
+    if restoreErr := os.Rename(oldDir, liveDir); restoreErr != nil {
+      return fmt.Errorf("%v (and restoring %s from %s failed: %v)", err, liveDir, oldDir, restoreErr)
+    }
+    return err
+  }
+  err = os.RemoveAll(oldDir)
+  if err != nil {
+    return fmt.Errorf("swapped %s into place, but could not remove the old directory: %w", liveDir, err)
+  }
+  return nil
+}
+
+// Reports whether two files are on the same device, assuming they are if the platform can't tell.
+func sameDevice(a os.FileInfo, b os.FileInfo) bool {
+  aID, aOK := deviceID(a)
+  bID, bOK := deviceID(b)
+  return !aOK || !bOK || aID == bID
+}
+
+// Extensions of formats that are already compressed, so zipping them gains ~nothing.
+var precompressedExtensions = map[string]bool{
+  ".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".7z": true, ".zst": true, ".rar": true,
+  ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+  ".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".mp4": true, ".mov": true, ".mkv": true, ".webm": true,
+}
+
+type countingWriter struct {
+  count int64
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+  writer.count += int64(len(data))
+  return len(data), nil
+}
+
+/*
+ * The compression of a single zip entry (or, from TotalEntryStats(), of a whole zip).
+ */
+type EntryStats struct {
+  Name string
+  CompressedSize uint64
+  UncompressedSize uint64
+  // UncompressedSize / CompressedSize: 0 for empty entries, +Inf for something from nothing.
+  Ratio float64
+  // Whether Ratio is above the threshold, which is what a zip bomb looks like.
+  Suspicious bool
+}
+
+/*
+ * Options for ZipCompressionStatsWithOptions(). The zero value behaves like ZipCompressionStats().
+ */
+type ZipStatsOptions struct {
+  // Entries that expand more than this many times are flagged as Suspicious.
+  // Defaults to 100; ordinary text rarely gets past 20, and bombs are in the thousands.
+  SuspiciousRatio float64
+}
+
+/*
+ * Report how much each entry of a zip file is compressed, without extracting anything.
+ * @param zipFilePath the zip file to inspect
+ * @returns the stats of each entry (in archive order), or an error
+ *
+ * Same as ZipCompressionStatsWithOptions() with the default options.
+ */
+func ZipCompressionStats(zipFilePath string) ([]EntryStats, error) {
+  return ZipCompressionStatsWithOptions(zipFilePath, ZipStatsOptions{})
+}
+
+/*
+ * Report how much each entry of a zip file is compressed, without extracting anything.
+ * @param zipFilePath the zip file to inspect
+ * @param options the threshold for flagging entries
+ * @returns the stats of each entry (in archive order), or an error
+ *
+ * The sizes come from the zip's central directory, so they're what the archive
+ * claims rather than what extracting would produce. A hostile archive can lie
+ * about them, so limit the bytes actually read when extracting untrusted zips too.
+ */
+func ZipCompressionStatsWithOptions(zipFilePath string, options ZipStatsOptions) ([]EntryStats, error) {
+  threshold := options.SuspiciousRatio
+  if threshold <= 0 {
+    threshold = 100
+  }
+  r, err := zip.OpenReader(zipFilePath)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  stats := make([]EntryStats, 0, len(r.File))
+  for _, f := range r.File {
+    stats = append(stats, newEntryStats(f.Name, f.CompressedSize64, f.UncompressedSize64, threshold))
+  }
+  return stats, nil
+}
+
+/*
+ * Add up the stats of many entries, e.g. to get the overall ratio of a zip.
+ * @param stats the entries, as returned by ZipCompressionStats()
+ * @param threshold the ratio above which the total counts as Suspicious (0 for the default of 100)
+ * @returns the combined stats, with an empty Name
+ */
+func TotalEntryStats(stats []EntryStats, threshold float64) EntryStats {
+  if threshold <= 0 {
+    threshold = 100
+  }
+  var compressed, uncompressed uint64
+  for _, entry := range stats {
+    compressed += entry.CompressedSize
+    uncompressed += entry.UncompressedSize
+  }
+  return newEntryStats("", compressed, uncompressed, threshold)
+}
+
+func newEntryStats(name string, compressed uint64, uncompressed uint64, threshold float64) EntryStats {
+  ratio := 0.0
+  if compressed > 0 {
+    ratio = float64(uncompressed) / float64(compressed)
+  } else if uncompressed > 0 {
+    ratio = math.Inf(1)
+  }
+  return EntryStats{name, compressed, uncompressed, ratio, ratio > threshold}
+}
+
+/*
+ * Estimate how large ZipDir() would make a directory's archive, without writing it.
+ * @param dirPath the directory to estimate
+ * @param sampleFraction the fraction (0 to 1] of compressible files to actually compress
+ * @returns the estimated archive size in bytes, or an error
+ *
+ * Files with extensions of already-compressed formats (".jpg", ".mp4", ".gz", ...)
+ * are counted at full size. Every 1/sampleFraction-th other file is compressed
+ * (into nowhere) to measure the achieved ratio, which is then applied to all of
+ * them, and zip's per-entry header overhead is added.
+ * This is only an estimate: a small fraction is fast but can be thrown off by
+ * unrepresentative files (say, one huge log among many binaries), while a
+ * fraction of 1 is exact up to the headers but costs as much CPU as zipping.
+ */
+func EstimateZipSize(dirPath string, sampleFraction float64) (int64, error) {
+  if sampleFraction <= 0 || sampleFraction > 1 {
+    return 0, errors.New("sampleFraction must be in (0, 1]")
+  }
+  stride := int(1 / sampleFraction + 0.5)
+  estimate := int64(22) // The end of central directory record.
+  compressibleBytes, sampledBytes, sampledCompressed := int64(0), int64(0), int64(0)
+  compressible := 0
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if info.IsDir() {
+      return nil
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil {
+      return err
+    }
+    // Local file header, data descriptor, and central directory header, each with the name.
+    estimate += 30 + 16 + 46 + 2 * int64(len(relPath))
+    if precompressedExtensions[strings.ToLower(filepath.Ext(filePath))] {
+      estimate += info.Size()
+      return nil
+    }
+    compressibleBytes += info.Size()
+    compressible++
+    if (compressible - 1) % stride != 0 {
+      return nil
+    }
+    file, err := os.Open(filePath)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    counter := &countingWriter{}
+    compressor, err := flate.NewWriter(counter, flate.DefaultCompression)
+    if err != nil {
+      return err
+    }
+    n, err := io.Copy(compressor, file)
+    if err != nil {
+      return err
+    }
+    err = compressor.Close()
+    if err != nil {
+      return err
+    }
+    sampledBytes += n
+    sampledCompressed += counter.count
+    return nil
+  })
+  if err != nil {
+    return 0, err
+  }
+  if sampledBytes > 0 {
+    estimate += int64(float64(compressibleBytes) * float64(sampledCompressed) / float64(sampledBytes))
+  }
+  return estimate, nil
+}
+
+/*
+ * Remove every empty directory inside a directory, e.g. after deleting some files.
+ * @param dirPath the directory to clean up; it is never removed itself
+ * @returns the paths of the removed directories (deepest first), or an error
+ *
+ * A directory whose only contents were empty directories is removed too.
+ */
+func RemoveEmptyDirs(dirPath string) ([]string, error) {
+  removed := []string{}
+  _, err := removeEmptyDirs(dirPath, &removed)
+  return removed, err
+}
+
+// Removes the empty directories inside dirPath and reports whether dirPath is now empty.
+func removeEmptyDirs(dirPath string, removed *[]string) (bool, error) {
+  children, err := ioutil.ReadDir(dirPath)
+  if err != nil {
+    return false, err
+  }
+  empty := true
+  for _, child := range children {
+    if !child.IsDir() {
+      empty = false
+      continue
+    }
+    childPath := filepath.Join(dirPath, child.Name())
+    childEmpty, err := removeEmptyDirs(childPath, removed)
+    if err != nil {
+      return false, err
+    }
+    if !childEmpty {
+      empty = false
+      continue
+    }
+    err = os.Remove(childPath)
+    if err != nil {
+      return false, err
+    }
+    *removed = append(*removed, childPath)
+  }
+  return empty, nil
+}
+
+/*
+ * Copy a file only if the destination doesn't already have the same contents.
+ * @param inPath the file to copy
+ * @param outPath where the copy should be
+ * @returns "created" if outPath didn't exist, "copied" if it differed, "skipped" if it matched, and an error
+ *
+ * Files are compared by size, then byte by byte, so timestamps don't matter.
+ */
+func SyncFile(inPath string, outPath string) (string, error) {
+  inInfo, err := os.Stat(inPath)
+  if err != nil {
+    return "", err
+  }
+  outInfo, err := os.Stat(outPath)
+  if os.IsNotExist(err) {
+    return "created", CopyFile(inPath, outPath)
+  }
+  if err != nil {
+    return "", err
+  }
+  if outInfo.IsDir() {
+    return "", fmt.Errorf("%s is a directory", outPath)
+  }
+  if inInfo.Size() == outInfo.Size() {
+    equal, err := filesEqual(inPath, outPath)
+    if err != nil {
+      return "", err
+    }
+    if equal {
+      return "skipped", nil
+    }
+  }
+  return "copied", CopyFile(inPath, outPath)
+}
+
+// Reports whether two files have the same contents.
+func filesEqual(aPath string, bPath string) (bool, error) {
+  a, err := os.Open(aPath)
+  if err != nil {
+    return false, err
+  }
+  defer a.Close()
+  b, err := os.Open(bPath)
+  if err != nil {
+    return false, err
+  }
+  defer b.Close()
+  aBuffer := make([]byte, 64 * 1024)
+  bBuffer := make([]byte, 64 * 1024)
+  for {
+    aN, aErr := io.ReadFull(a, aBuffer)
+    bN, bErr := io.ReadFull(b, bBuffer)
+    if !bytes.Equal(aBuffer[:aN], bBuffer[:bN]) {
+      return false, nil
+    }
+    aDone := aErr == io.EOF || aErr == io.ErrUnexpectedEOF
+    bDone := bErr == io.EOF || bErr == io.ErrUnexpectedEOF
+    if aErr != nil && !aDone {
+      return false, aErr
+    }
+    if bErr != nil && !bDone {
+      return false, bErr
+    }
+    if aDone || bDone {
+      return aDone == bDone, nil
+    }
+  }
+}
+
+/*
+ * Walk two directory trees together, visiting each relative path once.
+ * @param dirA the first tree (may be missing, in which case it's treated as empty)
+ * @param dirB the second tree (likewise)
+ * @param fn called for every path in either tree, with a nil FileInfo for the side it's missing from
+ * @returns the first error from fn or from reading the trees
+ *
+ * Paths are visited in sorted order, parents before children. If a path is a
+ * directory on one side and a file on the other, fn sees both, and only the
+ * directory's side is descended into. Returning filepath.SkipDir from fn skips
+ * a directory's contents (and does nothing for a file, unlike with filepath.Walk()).
+ * Symlinks are reported but not followed.
+ */
+func WalkPaired(dirA string, dirB string, fn func(relPath string, a, b os.FileInfo) error) error {
+  return walkPaired(dirA, dirB, "", fn)
+}
+
+// Visits the children of relPath in both trees. An empty dir means that side has no directory here.
+func walkPaired(dirA string, dirB string, relPath string, fn func(relPath string, a, b os.FileInfo) error) error {
+  childrenA, err := readDirIfExists(dirA)
+  if err != nil {
+    return err
+  }
+  childrenB, err := readDirIfExists(dirB)
+  if err != nil {
+    return err
+  }
+  i, j := 0, 0
+  for i < len(childrenA) || j < len(childrenB) {
+    var a, b os.FileInfo
+    if j >= len(childrenB) || (i < len(childrenA) && childrenA[i].Name() < childrenB[j].Name()) {
+      a = childrenA[i]
+      i++
+    } else if i >= len(childrenA) || childrenB[j].Name() < childrenA[i].Name() {
+      b = childrenB[j]
+      j++
+    } else {
+      a, b = childrenA[i], childrenB[j]
+      i++
+      j++
+    }
+    name := ""
+    if a != nil {
+      name = a.Name()
+    } else {
+      name = b.Name()
+    }
+    childPath := filepath.Join(relPath, name)
+    err = fn(childPath, a, b)
+    isDir := (a != nil && a.IsDir()) || (b != nil && b.IsDir())
+    if err == filepath.SkipDir {
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    if !isDir {
+      continue
+    }
+    childA, childB := "", ""
+    if a != nil && a.IsDir() {
+      childA = filepath.Join(dirA, name)
+    }
+    if b != nil && b.IsDir() {
+      childB = filepath.Join(dirB, name)
+    }
+    err = walkPaired(childA, childB, childPath, fn)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Lists a directory sorted by name, treating an empty path or a missing directory as empty.
+func readDirIfExists(dirPath string) ([]os.FileInfo, error) {
+  if dirPath == "" {
+    return nil, nil
+  }
+  children, err := ioutil.ReadDir(dirPath)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  return children, err
+}
+
+const packMagic = "PACKDIR1"
+
+/*
+ * Write a directory tree to a stream, in a simple format that UnpackDir() reads back.
+ * @param dirPath the directory to pack
+ * @param w where to write the packed tree
+ * @returns an error
+ *
+ * The format is a magic string followed by one record per file, directory, or
+ * symlink, parents first: a big-endian uint16 path length, the slash-separated
+ * relative path, a uint32 os.FileMode, a uint64 size, and then that many bytes
+ * (the file's contents or the symlink's target). Nothing is compressed or indexed,
+ * so it streams in both directions; use ZipDir() for anything leaving the app.
+ * Other file types (devices, sockets, ...) are an error.
+ */
+func PackDir(dirPath string, w io.Writer) error {
+  writer := bufio.NewWriter(w)
+  _, err := writer.WriteString(packMagic)
+  if err != nil {
+    return err
+  }
+  err = filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil || relPath == "." {
+      return err
+    }
+    relPath = filepath.ToSlash(relPath)
+    if len(relPath) > 0xffff {
+      return fmt.Errorf("path too long to pack: %s", filePath)
+    }
+    var content io.Reader
+    var size int64
+    switch {
+    case info.IsDir():
+    case info.Mode()&os.ModeSymlink != 0:
+      target, err := os.Readlink(filePath)
+      if err != nil {
+        return err
+      }
+      content = strings.NewReader(target)
+      size = int64(len(target))
+    case info.Mode().IsRegular():
+      file, err := os.Open(filePath)
+      if err != nil {
+        return err
+      }
+      defer file.Close()
+      content = file
+      size = info.Size()
+    default:
+      return fmt.Errorf("can't pack %s: unsupported file type", filePath)
+    }
+    header := make([]byte, 2 + len(relPath) + 4 + 8)
+    binary.BigEndian.PutUint16(header, uint16(len(relPath)))
+    copy(header[2:], relPath)
+    binary.BigEndian.PutUint32(header[2 + len(relPath):], uint32(info.Mode()))
+    binary.BigEndian.PutUint64(header[6 + len(relPath):], uint64(size))
+    _, err = writer.Write(header)
+    if err != nil || content == nil {
+      return err
+    }
+    // Copy exactly the size we recorded, in case the file changes under us.
+    n, err := io.Copy(writer, io.LimitReader(content, size))
+    if err == nil && n < size {
+      err = fmt.Errorf("%s shrank while being packed", filePath)
+    }
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  return writer.Flush()
+}
+
+/*
+ * Recreate a directory tree written by PackDir().
+ * @param r the packed tree
+ * @param destPath the directory to unpack into (created if missing)
+ * @returns an error
+ *
+ * Like UntarGz(), entries whose paths escape destPath (directly or through
+ * symlinks) are rejected, and so are absolute symlinks and ones that point
+ * outside it. Symlink targets over 4096 bytes are an error. Directory
+ * permissions are applied last, so a read-only directory can still be filled in.
+ */
+func UnpackDir(r io.Reader, destPath string) error {
+  reader := bufio.NewReader(r)
+  magic := make([]byte, len(packMagic))
+  _, err := io.ReadFull(reader, magic)
+  if err != nil || string(magic) != packMagic {
+    return errors.New("not a packed directory")
+  }
+  err = os.MkdirAll(destPath, 0755)
+  if err != nil {
+    return err
+  }
+  realDest, err := filepath.EvalSymlinks(destPath)
+  if err != nil {
+    return err
+  }
+  realDest, err = filepath.Abs(realDest)
+  if err != nil {
+    return err
+  }
+  dirModes := map[string]os.FileMode{}
+  dirOrder := []string{}
+  created := map[string]bool{}
+  symlinks := []extractedSymlink{}
+  lengthBytes := make([]byte, 2)
+  for {
+    _, err := io.ReadFull(reader, lengthBytes)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+    header := make([]byte, int(binary.BigEndian.Uint16(lengthBytes)) + 12)
+    _, err = io.ReadFull(reader, header)
+    if err != nil {
+      return noEOF(err)
+    }
+    name := string(header[:len(header) - 12])
+    mode := os.FileMode(binary.BigEndian.Uint32(header[len(header) - 12:]))
+    size := int64(binary.BigEndian.Uint64(header[len(header) - 8:]))
+    path, err := zipEntryPath(realDest, name)
+    if err != nil {
+      return err
+    }
+    if mode.IsDir() {
+      realPath, err := mkdirWithin(realDest, path, created)
+      if err != nil {
+        return err
+      }
+      dirModes[realPath] = mode.Perm()
+      dirOrder = append(dirOrder, realPath)
+      continue
+    }
+    parent, err := mkdirWithin(realDest, filepath.Dir(path), created)
+    if err != nil {
+      return err
+    }
+    path = filepath.Join(parent, filepath.Base(path))
+    // Replace whatever is there, so we never write through an existing symlink.
+    err = os.Remove(path)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    switch {
+    case mode&os.ModeSymlink != 0:
+      // PATH_MAX on Linux; the size can't be trusted to allocate.
+      if size > 4096 {
+        return fmt.Errorf("symlink target of %s is too long", name)
+      }
+      target := make([]byte, size)
+      _, err = io.ReadFull(reader, target)
+      if err != nil {
+        return noEOF(err)
+      }
+      if symlinkEscapes(realDest, parent, string(target)) {
+        return fmt.Errorf("illegal symlink target: %s -> %s", name, target)
+      }
+      err = os.Symlink(string(target), path)
+      symlinks = append(symlinks, extractedSymlink{path, parent, string(target)})
+    case mode.IsRegular():
+      var file *os.File
+      file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+      if err != nil {
+        return err
+      }
+      _, err = io.CopyN(file, reader, size)
+      if closeErr := file.Close(); err == nil {
+        err = closeErr
+      }
+      err = wrapDiskFull(path, noEOF(err))
+    default:
+      return fmt.Errorf("unsupported file type for %s", name)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return finishExtraction(realDest, symlinks, dirOrder, dirModes, created)
+}
+
+// A stream that ends part way through a record is truncated, not finished.
+func noEOF(err error) error {
+  if err == io.EOF {
+    return io.ErrUnexpectedEOF
+  }
+  return err
+}
+
+var ErrNotImage = errors.New("File is not a supported image")
+
+/*
+ * Get a small version of an image, generating it the first time it's asked for.
+ * @param srcPath the image (JPEG, PNG, or GIF, as detected by FileContentType())
+ * @param thumbDir the directory to cache thumbnails in (created if missing)
+ * @param maxDim the largest the thumbnail's width or height may be
+ * @returns the path of the thumbnail, or ErrNotImage, or another error
+ *
+ * Thumbnails are named after a hash of the source's contents, its modification
+ * time, and maxDim, so an edited image gets a new thumbnail and identical images
+ * share one. Stale thumbnails are never deleted; clear thumbDir now and then.
+ * Images are scaled down (never up) by averaging, and saved as PNG if the source
+ * was PNG or GIF (to keep transparency) and as JPEG otherwise. Only the first
+ * frame of an animated GIF is used.
+ */
+func EnsureThumbnail(srcPath string, thumbDir string, maxDim int) (string, error) {
+  if maxDim < 1 {
+    return "", fmt.Errorf("invalid thumbnail size: %d", maxDim)
+  }
+  contentType, err := FileContentType(srcPath)
+  if err != nil {
+    return "", err
+  }
+  extension := map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".png"}[contentType]
+  if extension == "" {
+    return "", ErrNotImage
+  }
+  info, err := os.Stat(srcPath)
+  if err != nil {
+    return "", err
+  }
+  digest, err := FileHash(srcPath, sha256.New())
+  if err != nil {
+    return "", err
+  }
+  key := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", digest, info.ModTime().UnixNano(), maxDim)))
+  thumbPath := filepath.Join(thumbDir, hex.EncodeToString(key[:16]) + extension)
+  if _, err := os.Stat(thumbPath); err == nil {
+    return thumbPath, nil
+  }
+  file, err := os.Open(srcPath)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  img, _, err := image.Decode(file)
+  if err != nil {
+    return "", fmt.Errorf("%w: %v", ErrNotImage, err)
+  }
+  thumb := scaleImageDown(img, maxDim)
+  err = os.MkdirAll(thumbDir, 0755)
+  if err != nil {
+    return "", err
+  }
+  err = writeFileAtomic(thumbPath, 0644, func(out *os.File) error {
+    if extension == ".png" {
+      return png.Encode(out, thumb)
+    }
+    return jpeg.Encode(out, thumb, &jpeg.Options{Quality: 85})
+  })
+  if err != nil {
+    return "", err
+  }
+  return thumbPath, nil
+}
+
+// Shrinks an image to fit in maxDim x maxDim, averaging the source pixels behind each output pixel.
+func scaleImageDown(img image.Image, maxDim int) image.Image {
+  bounds := img.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  if width <= maxDim && height <= maxDim {
+    return img
+  }
+  newWidth, newHeight := maxDim, maxDim
+  if width > height {
+    newHeight = height * maxDim / width
+  } else {
+    newWidth = width * maxDim / height
+  }
+  if newWidth < 1 {
+    newWidth = 1
+  }
+  if newHeight < 1 {
+    newHeight = 1
+  }
+  thumb := image.NewNRGBA(image.Rect(0, 0, newWidth, newHeight))
+  for y := 0; y < newHeight; y++ {
+    y0, y1 := bounds.Min.Y + y * height / newHeight, bounds.Min.Y + (y + 1) * height / newHeight
+    for x := 0; x < newWidth; x++ {
+      x0, x1 := bounds.Min.X + x * width / newWidth, bounds.Min.X + (x + 1) * width / newWidth
+      var r, g, b, a, n uint64
+      for sy := y0; sy < y1; sy++ {
+        for sx := x0; sx < x1; sx++ {
+          pr, pg, pb, pa := img.At(sx, sy).RGBA()
+          r, g, b, a, n = r + uint64(pr), g + uint64(pg), b + uint64(pb), a + uint64(pa), n + 1
+        }
+      }
+      // RGBA() is premultiplied, so divide by alpha to get NRGBA.
+      pixel := color.NRGBA{}
+      if a > 0 {
+        pixel = color.NRGBA{uint8(r * 0xff / a), uint8(g * 0xff / a), uint8(b * 0xff / a), uint8(a / n >> 8)}
+      }
+      thumb.SetNRGBA(x, y, pixel)
+    }
+  }
+  return thumb
+}
+
+/*
+ * Check that a copy of a directory (e.g. from CopyDir()) matches the original.
+ * @param src the original directory
+ * @param dst the copy
+ * @param byContent whether to compare the hashes of same-sized files too
+ * @returns one line per discrepancy (empty if the trees match), or an error
+ *
+ * Each discrepancy starts with its kind and then the relative path, e.g.
+ * "missing: a/b.txt" (only in src), "extra: c.txt" (only in dst), "type: d"
+ * (a file on one side and a directory on the other), "size: e.bin (10 vs 12)",
+ * "content: f.txt", or "symlink: g". Missing and extra directories are reported
+ * once, not once per file inside them. Permissions and timestamps aren't compared.
+ */
+func VerifyCopy(src string, dst string, byContent bool) ([]string, error) {
+  discrepancies := []string{}
+  err := WalkPaired(src, dst, func(relPath string, a, b os.FileInfo) error {
+    if b == nil {
+      discrepancies = append(discrepancies, "missing: " + relPath)
+      return filepath.SkipDir
+    }
+    if a == nil {
+      discrepancies = append(discrepancies, "extra: " + relPath)
+      return filepath.SkipDir
+    }
+    if a.Mode().Type() != b.Mode().Type() {
+      discrepancies = append(discrepancies, "type: " + relPath)
+      return filepath.SkipDir
+    }
+    if a.Mode()&os.ModeSymlink != 0 {
+      targetA, err := os.Readlink(filepath.Join(src, relPath))
+      if err != nil {
+        return err
+      }
+      targetB, err := os.Readlink(filepath.Join(dst, relPath))
+      if err != nil {
+        return err
+      }
+      if targetA != targetB {
+        discrepancies = append(discrepancies, "symlink: " + relPath)
+      }
+      return nil
+    }
+    if !a.Mode().IsRegular() {
+      return nil
+    }
+    if a.Size() != b.Size() {
+      discrepancies = append(discrepancies, fmt.Sprintf("size: %s (%d vs %d)", relPath, a.Size(), b.Size()))
+      return nil
+    }
+    if !byContent {
+      return nil
+    }
+    hashA, err := FileHash(filepath.Join(src, relPath), sha256.New())
+    if err != nil {
+      return err
+    }
+    hashB, err := FileHash(filepath.Join(dst, relPath), sha256.New())
+    if err != nil {
+      return err
+    }
+    if hashA != hashB {
+      discrepancies = append(discrepancies, "content: " + relPath)
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return discrepancies, nil
+}
+
+/*
+ * Options for ExtensionsInDirWithOptions(). The zero value behaves like ExtensionsInDir().
+ */
+type ExtensionsOptions struct {
+  // If set, the total size in bytes of each extension's files is added to it.
+  Bytes map[string]int64
+}
+
+/*
+ * Count the files in a directory tree by extension.
+ * @param dirPath the directory to look through
+ * @returns each lowercased extension (with its dot, e.g. ".go") and how many files have it, or an error
+ */
+func ExtensionsInDir(dirPath string) (map[string]int, error) {
+  return ExtensionsInDirWithOptions(dirPath, ExtensionsOptions{})
+}
+
+/*
+ * Count the files in a directory tree by extension.
+ * @param dirPath the directory to look through
+ * @param options what else to tally
+ * @returns each lowercased extension (with its dot, e.g. ".go") and how many files have it, or an error
+ *
+ * Files without an extension are counted under "", and so are dotfiles such as
+ * ".gitignore". Only regular files are counted; symlinks aren't followed.
+ */
+func ExtensionsInDirWithOptions(dirPath string, options ExtensionsOptions) (map[string]int, error) {
+  counts := map[string]int{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if !info.Mode().IsRegular() {
+      return nil
+    }
+    name := info.Name()
+    extension := strings.ToLower(filepath.Ext(name))
+    if extension == name {
+      extension = ""
+    }
+    counts[extension]++
+    if options.Bytes != nil {
+      options.Bytes[extension] += info.Size()
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return counts, nil
+}
+
+var ErrEscapesRoot = errors.New("Path resolves outside of the root")
+
+/*
+ * Find the real path of a file inside a root directory, following symlinks but not out of the root.
+ * @param root the directory requestPath must stay inside
+ * @param requestPath a slash-separated path relative to root (e.g. from a URL)
+ * @returns the absolute path with every symlink resolved, or ErrEscapesRoot, or another error
+ *
+ * ".." segments can't climb above root, since requestPath is cleaned as if root
+ * were "/". Unlike a purely textual check, this also catches symlinks inside the
+ * root that point outside it. The path must exist (symlinks can't be resolved
+ * otherwise), so a missing file gives an error satisfying os.IsNotExist().
+ * There's still a window between this check and opening the file in which the
+ * tree could change, so don't rely on it if untrusted users can create symlinks.
+ */
+func ResolveWithinRoot(root string, requestPath string) (string, error) {
+  realRoot, err := filepath.Abs(root)
+  if err != nil {
+    return "", err
+  }
+  realRoot, err = filepath.EvalSymlinks(realRoot)
+  if err != nil {
+    return "", err
+  }
+  joined := filepath.Join(realRoot, filepath.FromSlash(path.Clean("/" + requestPath)))
+  realPath, err := filepath.EvalSymlinks(joined)
+  if err != nil {
+    return "", err
+  }
+  if realPath != realRoot && !strings.HasPrefix(realPath, strings.TrimSuffix(realRoot, string(os.PathSeparator)) + string(os.PathSeparator)) {
+    return "", ErrEscapesRoot
+  }
+  return realPath, nil
+}
+
+/*
+ * One file, directory, or symlink in a DirManifest().
+ */
+type ManifestEntry struct {
+  // Relative to the manifest's directory, with forward slashes.
+  Path string
+  Mode os.FileMode
+  // Zero for directories and symlinks.
+  Size int64
+  // The hex-encoded hash of a file's contents; empty for directories and symlinks.
+  Hash string
+  // Where a symlink points; empty otherwise.
+  Target string
+}
+
+/*
+ * Describe every file in a directory tree in a stable form, e.g. for reproducible-build attestation.
+ * @param dirPath the directory to describe
+ * @param newHasher makes the hash to use for file contents (e.g. sha256.New)
+ * @returns the entries sorted by path, or an error
+ *
+ * Modification times and owners are left out, so two checkouts of the same
+ * sources give the same manifest. Symlinks are recorded by target, not followed.
+ * Use ManifestDigest() to boil the manifest down to a single value.
+ */
+func DirManifest(dirPath string, newHasher func() hash.Hash) ([]ManifestEntry, error) {
+  entries := []ManifestEntry{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil || relPath == "." {
+      return err
+    }
+    entry := ManifestEntry{Path: filepath.ToSlash(relPath), Mode: info.Mode()}
+    switch {
+    case info.Mode()&os.ModeSymlink != 0:
+      entry.Target, err = os.Readlink(filePath)
+    case info.Mode().IsRegular():
+      entry.Size = info.Size()
+      entry.Hash, err = FileHash(filePath, newHasher())
+    }
+    entries = append(entries, entry)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+  // Walk() sorts by OS path, which isn't quite the same order as slash-separated paths.
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].Path < entries[j].Path
+  })
+  return entries, nil
+}
+
+/*
+ * Hash a manifest from DirManifest() into one value.
+ * @param entries the manifest
+ * @param newHasher makes the hash to use (e.g. sha256.New)
+ * @returns the hex-encoded digest
+ *
+ * Each entry is hashed as a line of its quoted path, octal mode, size, hash, and
+ * quoted target, in the order given, so equal manifests give equal digests and
+ * any change to a path, mode, or file's contents changes the digest.
+ */
+func ManifestDigest(entries []ManifestEntry, newHasher func() hash.Hash) string {
+  hasher := newHasher()
+  for _, entry := range entries {
+    fmt.Fprintf(hasher, "%q %o %d %s %q\n", entry.Path, uint32(entry.Mode), entry.Size, entry.Hash, entry.Target)
+  }
+  return hex.EncodeToString(hasher.Sum(nil))
+}
+
+/*
+ * A file or directory in a DirSizeTree().
+ */
+type SizeNode struct {
+  Name string
+  IsDir bool
+  // For a file, its size. For a directory, the total size of everything inside it.
+  Size int64
+  // For a directory, the total size of the files directly inside it (not in subdirectories).
+  OwnSize int64
+  // Sorted by name. Empty for files.
+  Children []*SizeNode
+}
+
+/*
+ * Measure a directory tree with the size of every directory, e.g. to draw a treemap.
+ * @param dirPath the directory to measure
+ * @returns the tree rooted at dirPath, or an error
+ *
+ * Symlinks are counted as the size of the link itself, not followed.
+ */
+func DirSizeTree(dirPath string) (*SizeNode, error) {
+  var root *SizeNode
+  dirs := map[string]*SizeNode{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    node := &SizeNode{Name: info.Name(), IsDir: info.IsDir()}
+    if info.IsDir() {
+      dirs[filepath.Clean(filePath)] = node
+    } else {
+      node.Size = info.Size()
+    }
+    parent := dirs[filepath.Dir(filePath)]
+    if root == nil {
+      root = node
+    } else if parent != nil {
+      parent.Children = append(parent.Children, node)
+      if !info.IsDir() {
+        parent.OwnSize += node.Size
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  sumSizeNode(root)
+  return root, nil
+}
+
+// Fills in the Size of a directory node and all of the ones below it.
+func sumSizeNode(node *SizeNode) int64 {
+  if node.IsDir {
+    node.Size = 0
+    for _, child := range node.Children {
+      node.Size += sumSizeNode(child)
+    }
+  }
+  return node.Size
+}
+
+/*
+ * Read, change, and rewrite a JSON file without losing concurrent updates.
+ * @param filePath the JSON file
+ * @param update given the current contents (the zero value if the file doesn't exist), returns the new contents
+ * @returns an error from reading, update, or writing (if update fails, the file is left alone)
+ *
+ * While this runs, it holds a lock on "<filePath>.lock", so updates from other
+ * goroutines and processes that also use UpdateJSONFile() take turns instead of
+ * overwriting each other. On Linux, macOS, and the BSDs the lock is a flock() on
+ * that file, which the kernel releases if the holder dies; elsewhere the file's
+ * existence is the lock, and one left by a process that's no longer running is
+ * taken over. Waiting for the lock gives up after 10 seconds. The new contents
+ * are written atomically.
+ */
+func UpdateJSONFile[T any](filePath string, update func(current T) (T, error)) error {
+  unlock, err := lockFile(filePath + ".lock", 10 * time.Second)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  var current T
+  data, err := ioutil.ReadFile(filePath)
+  if err == nil {
+    err = json.Unmarshal(data, &current)
+    if err != nil {
+      return err
+    }
+  } else if !os.IsNotExist(err) {
+    return err
+  }
+  next, err := update(current)
+  if err != nil {
+    return err
+  }
+  data, err = json.MarshalIndent(next, "", "  ")
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(filePath, 0644, func(file *os.File) error {
+    _, err := file.Write(data)
+    return err
+  })
+}
+
+// Waits up to timeout for tryLockFile() to get the lock, and returns its unlock function.
+func lockFile(lockPath string, timeout time.Duration) (func(), error) {
+  deadline := time.Now().Add(timeout)
+  for {
+    unlock, err := tryLockFile(lockPath)
+    if err != nil {
+      return nil, err
+    }
+    if unlock != nil {
+      return unlock, nil
+    }
+    if time.Now().After(deadline) {
+      return nil, fmt.Errorf("timed out waiting for lock %s", lockPath)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+/*
+ * Copy a file to a writer, retrying reads that fail, e.g. to salvage data from failing media.
+ * @param filePath the file to read
+ * @param w where to write the file's contents
+ * @param retriesPerBlock how many more times to try reading a block after it fails
+ * @returns the number of bytes written, and the error of the block that couldn't be read (or from w)
+ *
+ * The file is read in 64 KB blocks at explicit offsets, so a retry starts again
+ * at the beginning of the failed block, after a short backoff (100 ms, 200 ms, ...).
+ * Everything before the bad block has been written to w when this gives up.
+ * Errors from w aren't retried.
+ */
+func StreamFileResilient(filePath string, w io.Writer, retriesPerBlock int) (int64, error) {
+  const blockSize = 64 << 10
+  file, err := os.Open(filePath)
+  if err != nil {
+    return 0, err
+  }
+  defer file.Close()
+  buffer := make([]byte, blockSize)
+  var written int64
+  for {
+    var n int
+    var readErr error
+    for attempt := 0; attempt <= retriesPerBlock; attempt++ {
+      if attempt > 0 {
+        time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+      }
+      n, readErr = file.ReadAt(buffer, written)
+      if readErr == nil || readErr == io.EOF {
+        break
+      }
+    }
+    if readErr != nil && readErr != io.EOF {
+      return written, fmt.Errorf("reading %s at offset %d: %w", filePath, written, readErr)
+    }
+    if n > 0 {
+      m, err := w.Write(buffer[:n])
+      written += int64(m)
+      if err != nil {
+        return written, err
+      }
+    }
+    if readErr == io.EOF || n == 0 {
+      return written, nil
+    }
+  }
+}
+
+/*
+ * Find the worst cases in a directory tree for platforms with path limits (e.g. Windows' MAX_PATH of 260).
+ * @param dirPath the directory to check
+ * @returns the longest path (including dirPath, so measure it against where the tree will end up),
+ *   the deepest nesting (as in UnzipOptions.MaxDepth, "a/b/c.txt" is 3 deep), and an error
+ *
+ * Only the current maximums are kept, so memory use doesn't grow with the tree.
+ * Lengths are in bytes; Windows counts UTF-16 code units, which is never more.
+ */
+func MaxPathStats(dirPath string) (string, int, error) {
+  longestPath := ""
+  maxDepth := 0
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if len(filePath) > len(longestPath) {
+      longestPath = filePath
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil || relPath == "." {
+      return err
+    }
+    depth := strings.Count(relPath, string(os.PathSeparator)) + 1
+    if depth > maxDepth {
+      maxDepth = depth
+    }
+    return nil
+  })
+  if err != nil {
+    return "", 0, err
+  }
+  return longestPath, maxDepth, nil
+}
+
+/*
+ * Call a function whenever a file changes, e.g. to hot-reload a config file.
+ * @param ctx stops the watching when done
+ * @param filePath the file to watch; it doesn't need to exist yet
+ * @param interval how often to check the file
+ * @param onChange called (from this goroutine) after each change is noticed
+ * @returns ctx's error once it's done
+ *
+ * The file's size and modification time are polled, so a change that keeps both
+ * (or happens within the filesystem's timestamp resolution) can be missed,
+ * and changes within one interval are reported once. Creating or deleting the
+ * file counts as a change, and a deleted file keeps being watched for its return.
+ */
+func WatchFile(ctx context.Context, filePath string, interval time.Duration, onChange func()) error {
+  type state struct {
+    exists bool
+    size int64
+    modTime time.Time
+  }
+  check := func() state {
+    info, err := os.Stat(filePath)
+    if err != nil {
+      return state{}
+    }
+    return state{true, info.Size(), info.ModTime()}
+  }
+  last := check()
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return ctx.Err()
+    case <-ticker.C:
+      current := check()
+      if current.exists != last.exists || current.size != last.size || !current.modTime.Equal(last.modTime) {
+        last = current
+        onChange()
+      }
+    }
+  }
+}
+
+/*
+ * Split a CSV file into smaller ones with a fixed number of rows each.
+ * @param inPath the CSV file to split
+ * @param outDir where to write the pieces (created if missing), named like "data_001.csv" for "data.csv"
+ * @param rowsPerFile the number of data rows in each piece (the last may have fewer)
+ * @param keepHeader whether the first row is a header to repeat at the top of every piece
+ * @returns the paths of the pieces in order, or an error
+ *
+ * The file is parsed with encoding/csv, so quoted fields containing commas or
+ * newlines stay in one record. Fields are re-quoted only where needed, so the
+ * pieces may not be byte-for-byte slices of the original.
+ */
+func SplitCSV(inPath string, outDir string, rowsPerFile int, keepHeader bool) ([]string, error) {
+  if rowsPerFile < 1 {
+    return nil, fmt.Errorf("invalid rows per file: %d", rowsPerFile)
+  }
+  inFile, err := os.Open(inPath)
+  if err != nil {
+    return nil, err
+  }
+  defer inFile.Close()
+  err = os.MkdirAll(outDir, 0755)
+  if err != nil {
+    return nil, err
+  }
+  reader := csv.NewReader(bufio.NewReader(inFile))
+  reader.FieldsPerRecord = -1
+  var header []string
+  if keepHeader {
+    header, err = reader.Read()
+    if err == io.EOF {
+      return []string{}, nil
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+  base := strings.TrimSuffix(filepath.Base(inPath), filepath.Ext(inPath))
+  created := []string{}
+  var outFile *os.File
+  var writer *csv.Writer
+  // Flushes and closes the current piece, if there is one.
+  finish := func() error {
+    if outFile == nil {
+      return nil
+    }
+    writer.Flush()
+    err := writer.Error()
+    if closeErr := outFile.Close(); err == nil {
+      err = closeErr
+    }
+    outFile = nil
+    return wrapDiskFull(created[len(created) - 1], err)
+  }
+  rows := 0
+  for {
+    record, err := reader.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      finish()
+      return created, err
+    }
+    if rows % rowsPerFile == 0 {
+      err = finish()
+      if err != nil {
+        return created, err
+      }
+      outPath := filepath.Join(outDir, fmt.Sprintf("%s_%03d.csv", base, len(created) + 1))
+      outFile, err = os.Create(outPath)
+      if err != nil {
+        return created, err
+      }
+      created = append(created, outPath)
+      writer = csv.NewWriter(outFile)
+      if header != nil {
+        writer.Write(header)
+      }
+    }
+    writer.Write(record)
+    rows++
+  }
+  return created, finish()
+}
+
+/*
+ * Save everything on standard input to a file, e.g. for `producer | tool save out.txt`.
+ * @param destPath the file to write
+ * @param perm the permissions of the file
+ * @returns the number of bytes copied, and an error
+ *
+ * The file is written atomically, so if stdin fails (or the disk fills up)
+ * part way through, destPath is left as it was.
+ */
+func CopyStdinToFile(destPath string, perm os.FileMode) (int64, error) {
+  var copied int64
+  err := writeFileAtomic(destPath, perm, func(file *os.File) error {
+    var err error
+    copied, err = io.Copy(file, os.Stdin)
+    return wrapDiskFull(destPath, err)
+  })
+  return copied, err
+}
+
+/*
+ * Write a file to standard output, e.g. for `tool cat in.txt | consumer`.
+ * @param srcPath the file to write out
+ * @returns the number of bytes copied, and an error (including if the consumer went away)
+ */
+func CopyFileToStdout(srcPath string) (int64, error) {
+  file, err := os.Open(srcPath)
+  if err != nil {
+    return 0, err
+  }
+  defer file.Close()
+  return io.Copy(os.Stdout, file)
+}
+
+// Random values for ChunkFileCDC()'s buzhash, from a fixed seed so chunk boundaries never change.
+var buzhashTable = func() [256]uint32 {
+  var table [256]uint32
+  state := uint64(0x9e3779b97f4a7c15)
+  for i := range table {
+    // splitmix64
+    state += 0x9e3779b97f4a7c15
+    z := state
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+    table[i] = uint32(z ^ (z >> 31))
+  }
+  return table
+}()
+
+/*
+ * Split a file into content-defined chunks, e.g. for a deduplicating backup store.
+ * @param filePath the file to split
+ * @param avgChunkSize the desired average chunk size in bytes (rounded up to a power of two)
+ * @param fn called with each chunk's offset, length, and hex SHA-256, in order
+ * @returns the first error from reading the file or from fn
+ *
+ * A boundary is placed wherever a rolling hash (buzhash) of the last 48 bytes
+ * has its low bits all zero, so boundaries depend only on nearby content:
+ * inserting or deleting bytes changes the chunks around the edit, while the
+ * rest of the file chunks (and hashes) exactly as before. Chunks are at least
+ * a quarter and at most 4 times the average size, except for the last one.
+ * The boundaries are stable across versions, so chunk hashes can be stored.
+ */
+func ChunkFileCDC(filePath string, avgChunkSize int, fn func(offset, length int64, hash string) error) error {
+  const window = 48
+  if avgChunkSize < window {
+    return fmt.Errorf("average chunk size must be at least %d bytes", window)
+  }
+  mask := uint32(1)
+  for int(mask) < avgChunkSize {
+    mask <<= 1
+  }
+  minSize, maxSize := int64(mask / 4), int64(mask) * 4
+  mask--
+  file, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  reader := bufio.NewReaderSize(file, 1 << 20)
+  hasher := sha256.New()
+  var ring [window]byte
+  var rolling uint32
+  var offset, length, position int64
+  emit := func() error {
+    err := fn(offset, length, hex.EncodeToString(hasher.Sum(nil)))
+    hasher.Reset()
+    offset += length
+    length = 0
+    return err
+  }
+  chunk := make([]byte, 0, 64 << 10)
+  for {
+    b, err := reader.ReadByte()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+    rolling = bits.RotateLeft32(rolling, 1) ^ buzhashTable[b]
+    if position >= window {
+      // Remove the byte leaving the window, which has been rotated window times since it was added.
+      rolling ^= bits.RotateLeft32(buzhashTable[ring[position % window]], window % 32)
+    }
+    ring[position % window] = b
+    position++
+    length++
+    chunk = append(chunk, b)
+    if len(chunk) == cap(chunk) {
+      hasher.Write(chunk)
+      chunk = chunk[:0]
+    }
+    if (length >= minSize && rolling & mask == 0) || length >= maxSize {
+      hasher.Write(chunk)
+      chunk = chunk[:0]
+      err = emit()
+      if err != nil {
+        return err
+      }
+    }
+  }
+  if length > 0 {
+    hasher.Write(chunk)
+    return emit()
+  }
+  return nil
+}
+
+/*
+ * Returned by CopyFilesPreservingTimes() when some of the copies fail.
+ */
+type CopyFilesError struct {
+  // Maps each failed source path to its error.
+  Errors map[string]error
+}
+
+func (err *CopyFilesError) Error() string {
+  sources := make([]string, 0, len(err.Errors))
+  for src := range err.Errors {
+    sources = append(sources, src)
+  }
+  sort.Strings(sources)
+  messages := make([]string, len(sources))
+  for i, src := range sources {
+    messages[i] = src + ": " + err.Errors[src].Error()
+  }
+  return fmt.Sprintf("%d files failed to copy: %s", len(sources), strings.Join(messages, "; "))
+}
+
+/*
+ * Copy many files, giving each copy the access and modification times of its source.
+ * @param pairs maps each source path to its destination path
+ * @returns a *CopyFilesError listing the files that failed (the others are still copied), or nil
+ *
+ * Access times are only read on Linux; elsewhere the copy's access time is set
+ * to the source's modification time. A destination whose copy or timestamps
+ * failed may have been left behind.
+ */
+func CopyFilesPreservingTimes(pairs map[string]string) error {
+  failed := map[string]error{}
+  for src, dst := range pairs {
+    info, err := os.Stat(src)
+    if err == nil {
+      err = CopyFile(src, dst)
+    }
+    if err == nil {
+      accessTime, ok := fileAccessTime(info)
+      if !ok {
+        accessTime = info.ModTime()
+      }
+      err = os.Chtimes(dst, accessTime, info.ModTime())
+    }
+    if err != nil {
+      failed[src] = err
+    }
+  }
+  if len(failed) > 0 {
+    return &CopyFilesError{failed}
+  }
+  return nil
+}
+
+/*
+ * Options for DirModTimeWithOptions(). The zero value behaves like DirModTime().
+ */
+type DirModTimeOptions struct {
+  // Count the modification times of directories too. A directory's time changes
+  // when entries are added, removed, or renamed in it, so this catches deletions,
+  // which the files' times alone can't.
+  IncludeDirs bool
+}
+
+/*
+ * Find when anything in a directory tree last changed, e.g. for a Last-Modified header.
+ * @param dirPath the directory to check
+ * @returns the latest modification time of the files inside (or dirPath's own, if there are none), or an error
+ */
+func DirModTime(dirPath string) (time.Time, error) {
+  return DirModTimeWithOptions(dirPath, DirModTimeOptions{})
+}
+
+/*
+ * Find when anything in a directory tree last changed, e.g. for a Last-Modified header.
+ * @param dirPath the directory to check
+ * @param options what to count
+ * @returns the latest modification time found (or dirPath's own, if there's nothing to count), or an error
+ *
+ * Only stats are read, never file contents. Symlinks count with their own times.
+ */
+func DirModTimeWithOptions(dirPath string, options DirModTimeOptions) (time.Time, error) {
+  var latest, own time.Time
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if filePath == dirPath {
+      own = info.ModTime()
+    }
+    if (!info.IsDir() || options.IncludeDirs) && info.ModTime().After(latest) {
+      latest = info.ModTime()
+    }
+    return nil
+  })
+  if err != nil {
+    return time.Time{}, err
+  }
+  if latest.IsZero() {
+    return own, nil
+  }
+  return latest, nil
+}
+
+/*
+ * Copy a directory into a new temporary directory, to work on without touching the original.
+ * @param srcPath the directory to copy
+ * @returns the path of the copy (which keeps srcPath's name, or is "copy" for a root
+ *   directory), a function that deletes it, and an error
+ *
+ * The copy is made with CopyDir() inside a fresh directory from ioutil.TempDir().
+ * cleanup removes that directory and everything in it; it may be called more than
+ * once, and only ever deletes the directory this call created. If the copy
+ * fails, nothing is left behind.
+ */
+func CopyDirToTemp(srcPath string) (string, func() error, error) {
+  absPath, err := filepath.Abs(srcPath)
+  if err != nil {
+    return "", nil, err
+  }
+  base := filepath.Base(absPath)
+  // The root of a filesystem has no name of its own.
+  if base == string(os.PathSeparator) || base == "." {
+    base = "copy"
+  }
+  tempDir, err := ioutil.TempDir("", base + "-")
+  if err != nil {
+    return "", nil, err
+  }
+  once := sync.Once{}
+  var cleanupErr error
+  cleanup := func() error {
+    once.Do(func() {
+      cleanupErr = os.RemoveAll(tempDir)
+    })
+    return cleanupErr
+  }
+  copyPath := filepath.Join(tempDir, base)
+  err = CopyDir(srcPath, copyPath)
+  if err != nil {
+    cleanup()
+    return "", nil, err
+  }
+  return copyPath, cleanup, nil
+}
+
+/*
+ * Hash the layout of a directory: which paths exist and what type they are, but not what's in them.
+ * @param dirPath the directory to hash
+ * @returns the hex-encoded sha256 digest, and an error
+ *
+ * Two trees with the same files, directories, and symlinks at the same relative
+ * paths hash the same regardless of file contents, sizes, modes, or symlink
+ * targets, which makes it handy for checking that a template produced the
+ * expected structure. Symlinks aren't followed.
+ */
+func DirStructureHash(dirPath string) (string, error) {
+  lines := []string{}
+  err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    relPath, err := filepath.Rel(dirPath, filePath)
+    if err != nil || relPath == "." {
+      return err
+    }
+    marker := "o"
+    switch {
+    case info.IsDir():
+      marker = "d"
+    case info.Mode()&os.ModeSymlink != 0:
+      marker = "l"
+    case info.Mode().IsRegular():
+      marker = "f"
+    }
+    lines = append(lines, fmt.Sprintf("%s %q\n", marker, filepath.ToSlash(relPath)))
+    return nil
+  })
   if err != nil {
     return "", err
   }
-  buffer := make([]byte, 512)
-  _, err := file.Read(buffer)
-  if err != nil {
-    return "", err
+  // Sort by path (after the marker) so the order doesn't depend on the OS separator.
+  sort.Slice(lines, func(i, j int) bool {
+    return lines[i][2:] < lines[j][2:]
+  })
+  hasher := sha256.New()
+  for _, line := range lines {
+    io.WriteString(hasher, line)
   }
-  contentType := http.DetectContentType(buffer)
-  return contentType, nil
+  return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 /*
- * Computes a hexadecimal hash of the file at the given path
- * @param filePath the file to compute the has of
- * @param hasher which hashing algorithm to use
- * @returns the hexadecimal hash or an error
+ * Quickly check whether a zip file looks whole, e.g. to catch a truncated download.
+ * @param zipFilePath the file to check
+ * @returns whether the file ends with a valid End Of Central Directory record, and an I/O error
  *
- * Example Usage:
- *   import (
- *     "crypto/md5"
- *     "crypto/sha256"
- *   )
- *   func main() {
- *     md5Hash, err := util.FileHash("foo.png", md5.New())
- *     sha256Hash, err := util.FileHash("foo.png", sha256.New())
- *   }
+ * Only the tail of the file and the start of the central directory are read:
+ * the End Of Central Directory record (or its ZIP64 version) must be present and
+ * point at a central directory that lies inside the file. Entries' contents and
+ * CRCs aren't checked; only reading every entry (as Unzip() does) catches corruption.
+ * A file that's readable but structurally incomplete returns false, not an error.
  */
-func FileHash(filePath string, hasher hash.Hash) (string, error) {
-  // https://stackoverflow.com/a/40436529/4004969
-  file, err := os.Open(filePath)
+func IsZipComplete(zipFilePath string) (bool, error) {
+  file, err := os.Open(zipFilePath)
   if err != nil {
-    return "", err
+    return false, err
   }
   defer file.Close()
-  if _, err := io.Copy(hasher, file); err != nil {
-    return "", err
+  info, err := file.Stat()
+  if err != nil {
+    return false, err
   }
-  return hex.EncodeToString(hasher.Sum(nil)), nil
+  size := info.Size()
+  // The record is 22 bytes, followed by a comment of up to 65535 bytes.
+  tailSize := int64(22 + 65535)
+  if tailSize > size {
+    tailSize = size
+  }
+  tail := make([]byte, tailSize)
+  _, err = file.ReadAt(tail, size - tailSize)
+  if err != nil {
+    return false, err
+  }
+  recordAt := -1
+  for i := len(tail) - 22; i >= 0; i-- {
+    if binary.LittleEndian.Uint32(tail[i:]) == 0x06054b50 && i + 22 + int(binary.LittleEndian.Uint16(tail[i + 20:])) <= len(tail) {
+      recordAt = i
+      break
+    }
+  }
+  if recordAt < 0 {
+    return false, nil
+  }
+  record := tail[recordAt:]
+  recordOffset := size - tailSize + int64(recordAt)
+  entries := uint64(binary.LittleEndian.Uint16(record[10:]))
+  dirSize := uint64(binary.LittleEndian.Uint32(record[12:]))
+  dirOffset := uint64(binary.LittleEndian.Uint32(record[16:]))
+  dirEnd := uint64(recordOffset)
+  if entries == 0xffff || dirSize == 0xffffffff || dirOffset == 0xffffffff {
+    // ZIP64: a 20-byte locator just before the record points at the real one.
+    if recordOffset < 20 {
+      return false, nil
+    }
+    locator := make([]byte, 20)
+    _, err = file.ReadAt(locator, recordOffset - 20)
+    if err != nil {
+      return false, err
+    }
+    zip64Offset := binary.LittleEndian.Uint64(locator[8:])
+    if binary.LittleEndian.Uint32(locator) != 0x07064b50 || recordOffset < 76 || zip64Offset > uint64(recordOffset - 76) {
+      return false, nil
+    }
+    zip64Record := make([]byte, 56)
+    _, err = file.ReadAt(zip64Record, int64(zip64Offset))
+    if err != nil {
+      return false, err
+    }
+    if binary.LittleEndian.Uint32(zip64Record) != 0x06064b50 {
+      return false, nil
+    }
+    entries = binary.LittleEndian.Uint64(zip64Record[32:])
+    dirSize = binary.LittleEndian.Uint64(zip64Record[40:])
+    dirOffset = binary.LittleEndian.Uint64(zip64Record[48:])
+    dirEnd = zip64Offset
+  }
+  if dirOffset > dirEnd || dirSize > dirEnd - dirOffset {
+    return false, nil
+  }
+  if entries == 0 {
+    return true, nil
+  }
+  if dirSize < 4 {
+    return false, nil
+  }
+  signature := make([]byte, 4)
+  _, err = file.ReadAt(signature, int64(dirOffset))
+  if err != nil {
+    return false, err
+  }
+  return binary.LittleEndian.Uint32(signature) == 0x02014b50, nil
 }
 
 /*
- * Checks whether a file or directory exists at the given path
- * @param path the path to check
- * @returns (whether the entity is a directory, whether the entity is a file, error)
+ * Update a copy of a file by rewriting only the blocks that changed.
+ * @param srcPath the file to copy
+ * @param dstPath the copy to bring up to date
+ * @param blockSize how many bytes to compare at a time, or 0 for 1 MB
+ * @returns the number of bytes actually written to dstPath, and an error
  *
- * Exhaustive interpretations:
- * (false, false, nil)    no entity exists here
- * (true, false, nil)     a directory exists here
- * (false, true, nil)     a file exists here
- * (false, false, error)  an error occured
+ * When dstPath exists, the two files are read side by side and each block of
+ * dstPath that differs from srcPath is overwritten in place, so a large file
+ * that changed only slightly (e.g. a database) isn't rewritten in full. If
+ * srcPath is longer the extra data is appended, and if it's shorter dstPath is
+ * truncated. If dstPath doesn't exist, this is CopyFile().
+ * Unlike CopyFile(), dstPath is modified in place, so a reader (or a crash) can
+ * catch it half updated.
  */
-func IsDirFile(filePath string) (bool, bool, error) {
-  file, err := os.Open(filePath)
+func DeltaCopyFile(srcPath string, dstPath string, blockSize int) (int64, error) {
+  if blockSize <= 0 {
+    blockSize = 1 << 20
+  }
+  src, err := os.Open(srcPath)
+  if err != nil {
+    return 0, err
+  }
+  defer src.Close()
+  srcInfo, err := src.Stat()
+  if err != nil {
+    return 0, err
+  }
+  dst, err := os.OpenFile(dstPath, os.O_RDWR, 0)
   if os.IsNotExist(err) {
-    return false, false, nil
+    err = CopyFile(srcPath, dstPath)
+    if err != nil {
+      return 0, err
+    }
+    return srcInfo.Size(), nil
   }
   if err != nil {
-    return false, false, err
+    return 0, err
   }
-  defer file.Close()
-
-  fileInfo, err := file.Stat()
+  defer dst.Close()
+  srcBlock := make([]byte, blockSize)
+  dstBlock := make([]byte, blockSize)
+  var written int64
+  for offset := int64(0); ; offset += int64(blockSize) {
+    n, err := io.ReadFull(src, srcBlock)
+    if err == io.EOF {
+      break
+    }
+    if err != nil && err != io.ErrUnexpectedEOF {
+      return written, err
+    }
+    m, err := dst.ReadAt(dstBlock[:n], offset)
+    if err != nil && err != io.EOF {
+      return written, err
+    }
+    if m == n && bytes.Equal(srcBlock[:n], dstBlock[:n]) {
+      continue
+    }
+    _, err = dst.WriteAt(srcBlock[:n], offset)
+    if err != nil {
+      return written, wrapDiskFull(dstPath, err)
+    }
+    written += int64(n)
+  }
+  err = dst.Truncate(srcInfo.Size())
   if err != nil {
-    return false, false, err
+    return written, err
   }
-  rtn := fileInfo.IsDir()
-  return rtn, !rtn, nil
+  return written, dst.Close()
 }
 
 /*
- * Zip a file.
- * @param filePath the file to compress
- * @param where to place the newly created ZIP file.
+ * Where a file is stored in a blob made by PackFiles().
+ */
+type PackedFile struct {
+  Offset int64
+  Length int64
+  // The hex-encoded sha256 of the file's contents.
+  Hash string
+}
+
+var ErrPackedFileCorrupt = errors.New("Packed file does not match its hash")
+
+/*
+ * Concatenate many small files into one blob, with a JSON index for finding each one again.
+ * @param paths the files to pack
+ * @param blobPath where to write the blob
+ * @param indexPath where to write the index, which maps each of paths (as given) to a PackedFile
  * @returns an error
+ *
+ * Thousands of tiny files cost far less disk space and far fewer opens as a
+ * single blob; read them back with ReadPackedFile(). Both files are written
+ * atomically. Listing the same path twice is an error.
  */
-func ZipFile(filePath string, zipFilePath string) error {
-  archive, err := os.Create(zipFilePath)
+func PackFiles(paths []string, blobPath string, indexPath string) error {
+  index := map[string]PackedFile{}
+  err := writeFileAtomic(blobPath, 0644, func(blob *os.File) error {
+    offset := int64(0)
+    for _, filePath := range paths {
+      if _, ok := index[filePath]; ok {
+        return fmt.Errorf("%s is listed more than once", filePath)
+      }
+      file, err := os.Open(filePath)
+      if err != nil {
+        return err
+      }
+      hasher := sha256.New()
+      n, err := io.Copy(io.MultiWriter(blob, hasher), file)
+      file.Close()
+      if err != nil {
+        return wrapDiskFull(blobPath, err)
+      }
+      index[filePath] = PackedFile{offset, n, hex.EncodeToString(hasher.Sum(nil))}
+      offset += n
+    }
+    return nil
+  })
   if err != nil {
     return err
   }
-  defer archive.Close()
-  zipWriter := zip.NewWriter(archive)
-  defer zipWriter.Close()
-
-  f1, err := os.Open(filePath)
+  data, err := json.MarshalIndent(index, "", "  ")
   if err != nil {
     return err
   }
-  defer f1.Close()
+  return writeFileAtomic(indexPath, 0644, func(file *os.File) error {
+    _, err := file.Write(data)
+    return wrapDiskFull(indexPath, err)
+  })
+}
 
-  w1, err := zipWriter.Create(path.Base(filePath))
+/*
+ * Read one file back out of a blob made by PackFiles().
+ * @param blobPath the blob
+ * @param indexPath the blob's index
+ * @param name the file's path, exactly as it was passed to PackFiles()
+ * @returns the file's contents, or ErrMemberNotFound, ErrPackedFileCorrupt, or another error
+ *
+ * Only the file's own bytes are read from the blob. The index is parsed on
+ * every call, so callers reading many files should cache it.
+ */
+func ReadPackedFile(blobPath string, indexPath string, name string) ([]byte, error) {
+  indexData, err := ioutil.ReadFile(indexPath)
   if err != nil {
-    return err
+    return nil, err
   }
-  if _, err := io.Copy(w1, f1); err != nil {
-    return err
+  index := map[string]PackedFile{}
+  err = json.Unmarshal(indexData, &index)
+  if err != nil {
+    return nil, err
   }
-  return nil
+  entry, ok := index[name]
+  if !ok {
+    return nil, fmt.Errorf("%w: %s", ErrMemberNotFound, name)
+  }
+  blob, err := os.Open(blobPath)
+  if err != nil {
+    return nil, err
+  }
+  defer blob.Close()
+  data := make([]byte, entry.Length)
+  _, err = blob.ReadAt(data, entry.Offset)
+  if err == io.EOF {
+    return nil, fmt.Errorf("%w: %s is cut short", ErrPackedFileCorrupt, name)
+  }
+  if err != nil {
+    return nil, err
+  }
+  sum := sha256.Sum256(data)
+  if hex.EncodeToString(sum[:]) != entry.Hash {
+    return nil, fmt.Errorf("%w: %s", ErrPackedFileCorrupt, name)
+  }
+  return data, nil
 }
 
 /*
- * Zip a directory.
- * @param dirPath the directory to compress
- * @param where to place the newly created ZIP file.
- * @returns an error
+ * Options for CopyDirAdaptiveWithOptions(). Zero values are chosen automatically.
  */
-func ZipDir(dirPath string, zipFilePath string) error {
-  // https://stackoverflow.com/a/63233911/4004969
-  file, err := os.Create(zipFilePath)
-  if err != nil {
-    return err
-  }
-  defer file.Close()
+type AdaptiveCopyOptions struct {
+  // How many files to copy one at a time, timing them, before choosing the rest
+  // of the settings. Defaults to 8.
+  SampleFiles int
+  // How many files to copy at once after the sample.
+  Workers int
+  // The copy buffer for each file (see CopyFileOptions.BufferSize).
+  BufferSize int
+  // When to fsync each copy. nil chooses per file.
+  SyncMode *SyncMode
+}
 
-  w := zip.NewWriter(file)
-  defer w.Close()
+/*
+ * Copy a directory as fast as the storage allows, without having to know what the storage is.
+ * @param srcPath the directory to copy
+ * @param dstPath where to create the copy; nothing may exist here yet
+ * @returns how much was copied and how long it took, and an error
+ *
+ * Same as CopyDirAdaptiveWithOptions() with everything chosen automatically.
+ */
+func CopyDirAdaptive(srcPath string, dstPath string) (OpStats, error) {
+  return CopyDirAdaptiveWithOptions(srcPath, dstPath, AdaptiveCopyOptions{})
+}
 
-  walker := func(path string, info os.FileInfo, err error) error {
+/*
+ * Copy a directory, tuning the copy to the storage as it goes.
+ * @param srcPath the directory to copy
+ * @param dstPath where to create the copy; nothing may exist here yet
+ * @param options settings to use instead of the automatic ones
+ * @returns how much was copied and how long it took, and an error
+ *
+ * The directories are created first, then the first SampleFiles files are
+ * copied one at a time to measure throughput. The rest are copied in parallel:
+ *   - Workers: 8 if IsSolidState() says dstPath is on an SSD, 1 on a spinning
+ *     disk (where parallel writes just seek), and otherwise 4 if the sample
+ *     managed 100 MB/s and 2 if not.
+ *   - BufferSize: OptimalCopyBuffer() of each file's size, doubled (up to 8 MB)
+ *     if the sample was under 50 MB/s, since slow storage is often high-latency
+ *     storage (e.g. a network share) that does better with fewer, larger requests.
+ *   - SyncMode: SyncOnClose, or SyncEveryNBytes for files of 64 MB or more, so
+ *     every file is durable once this returns and huge files don't pile up
+ *     dirty pages.
+ * Symbolic links are copied like CopyDir() copies them, and files and
+ * directories keep their permission bits (directories get theirs once
+ * everything is copied). On an error, the copies still in progress finish and
+ * no new ones start.
+ */
+func CopyDirAdaptiveWithOptions(srcPath string, dstPath string, options AdaptiveCopyOptions) (OpStats, error) {
+  start := time.Now()
+  stats := OpStats{}
+  separator := string(os.PathSeparator)
+  if strings.HasPrefix(filepath.Clean(dstPath) + separator, filepath.Clean(srcPath) + separator) {
+    return stats, errors.New("Cannot copy a folder into the folder itself!")
+  }
+  info, err := os.Stat(srcPath)
+  if err != nil {
+    return stats, err
+  }
+  if !info.IsDir() {
+    return stats, fmt.Errorf("Source %s is not a directory!", srcPath)
+  }
+  type pendingFile struct {
+    src string
+    dst string
+    size int64
+    mode os.FileMode
+  }
+  files := []pendingFile{}
+  // Directories and their modes, applied once their contents are copied, since
+  // a read-only directory couldn't be filled.
+  dirs := []pendingFile{}
+  err = filepath.Walk(srcPath, func(filePath string, info os.FileInfo, err error) error {
     if err != nil {
       return err
     }
-    if info.IsDir() {
-      return nil
-    }
-    file, err := os.Open(path)
+    relPath, err := filepath.Rel(srcPath, filePath)
     if err != nil {
       return err
     }
-    defer file.Close()
-
-    // Ensure that `path` is not absolute; it should not start with "/".
-    // This snippet happens to work because I don't use 
-    // absolute paths, but ensure your real-world code 
-    // transforms path into a zip-root relative path.
-    // TODO
-    f, err := w.Create(path[len(dirPath):])
+    target := filepath.Join(dstPath, relPath)
+    if info.IsDir() {
+      dirs = append(dirs, pendingFile{filePath, target, 0, info.Mode().Perm()})
+      return os.Mkdir(target, 0700)
+    }
+    if info.Mode() & os.ModeSymlink != 0 {
+      // The link's target is copied, so it gets the target's mode.
+      info, err = os.Stat(filePath)
+      if err != nil {
+        return err
+      }
+    }
+    files = append(files, pendingFile{filePath, target, info.Size(), info.Mode().Perm()})
+    return nil
+  })
+  if err != nil {
+    stats.Elapsed = time.Since(start)
+    return stats, err
+  }
+  throughput := 0.0
+  copyOne := func(file pendingFile) error {
+    copyOptions := CopyFileOptions{BufferSize: options.BufferSize, SyncMode: SyncOnClose}
+    if options.SyncMode != nil {
+      copyOptions.SyncMode = *options.SyncMode
+    } else if file.size >= 64 << 20 {
+      copyOptions.SyncMode = SyncEveryNBytes
+    }
+    if copyOptions.BufferSize <= 0 && throughput > 0 && throughput < 50e6 {
+      copyOptions.BufferSize = OptimalCopyBuffer(file.size) * 2
+      if copyOptions.BufferSize > 8 << 20 {
+        copyOptions.BufferSize = 8 << 20
+      }
+    }
+    err := CopyFileWithOptions(file.src, file.dst, copyOptions)
     if err != nil {
       return err
     }
-
-    _, err = io.Copy(f, file)
+    return os.Chmod(file.dst, file.mode)
+  }
+  sampleCount := options.SampleFiles
+  if sampleCount <= 0 {
+    sampleCount = 8
+  }
+  if sampleCount > len(files) {
+    sampleCount = len(files)
+  }
+  sampleStart := time.Now()
+  for _, file := range files[:sampleCount] {
+    err = copyOne(file)
     if err != nil {
-      return err
+      stats.Elapsed = time.Since(start)
+      return stats, err
+    }
+    stats.FilesProcessed++
+    stats.BytesProcessed += file.size
+  }
+  if elapsed := time.Since(sampleStart); elapsed > 0 {
+    throughput = float64(stats.BytesProcessed) / elapsed.Seconds()
+  }
+  workers := options.Workers
+  if workers <= 0 {
+    solidState, err := IsSolidState(dstPath)
+    switch {
+    case err == nil && solidState:
+      workers = 8
+    case err == nil:
+      workers = 1
+    case throughput >= 100e6:
+      workers = 4
+    default:
+      workers = 2
     }
+  }
+  var firstErr error
+  lock := sync.Mutex{}
+  jobs := make(chan pendingFile)
+  group := sync.WaitGroup{}
+  for i := 0; i < workers; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      for file := range jobs {
+        lock.Lock()
+        failed := firstErr != nil
+        lock.Unlock()
+        if failed {
+          continue
+        }
+        err := copyOne(file)
+        lock.Lock()
+        if err != nil && firstErr == nil {
+          firstErr = err
+        } else if err == nil {
+          stats.FilesProcessed++
+          stats.BytesProcessed += file.size
+        }
+        lock.Unlock()
+      }
+    }()
+  }
+  for _, file := range files[sampleCount:] {
+    jobs <- file
+  }
+  close(jobs)
+  group.Wait()
+  // Children before parents, so a read-only parent doesn't block its children.
+  for i := len(dirs) - 1; i >= 0 && firstErr == nil; i-- {
+    firstErr = os.Chmod(dirs[i].dst, dirs[i].mode)
+  }
+  stats.Elapsed = time.Since(start)
+  return stats, firstErr
+}
 
-    return nil
+var ioSlots chan struct{}
+var ioSlotsLock sync.Mutex
+
+/*
+ * Limit how many heavy disk operations may run at once, across all goroutines.
+ * @param n the most that may run at once, or 0 (the default) for no limit
+ *
+ * Once set, each of these waits for a free slot before touching the disk, and
+ * holds it for the rest of that one file:
+ *   - CopyFileWithOptions(), and so CopyFile() and every copy made by CopyDir(),
+ *     CopyDirWithOptions(), and CopyDirAdaptive() (one slot per file, so
+ *     CopyDirAdaptive()'s workers are capped by this too)
+ *   - extracting each entry in Unzip(), UnzipWithOptions(), UnzipWithProgress(),
+ *     UnzipMatching(), and SyncZipToDir()
+ *   - DownloadFile(), DownloadAll(), and DownloadAllContext(), from the response
+ *     headers until the file is written; DownloadAllContext() stops waiting if
+ *     its context is cancelled
+ * This keeps a busy server from thrashing the disk with hundreds of simultaneous
+ * copies. Changing the limit only affects operations that start afterwards.
+ */
+func SetMaxConcurrentIO(n int) {
+  ioSlotsLock.Lock()
+  defer ioSlotsLock.Unlock()
+  if n <= 0 {
+    ioSlots = nil
+  } else {
+    ioSlots = make(chan struct{}, n)
   }
-  err = filepath.Walk(dirPath, walker)
-  if err != nil {
-    return err
+}
+
+// Waits for a slot under SetMaxConcurrentIO()'s limit. The error is only ever ctx's.
+func acquireIO(ctx context.Context) (func(), error) {
+  ioSlotsLock.Lock()
+  slots := ioSlots
+  ioSlotsLock.Unlock()
+  if slots == nil {
+    return func() {}, nil
+  }
+  select {
+  case slots <- struct{}{}:
+    return func() { <-slots }, nil
+  case <-ctx.Done():
+    return func() {}, ctx.Err()
   }
-  return nil
 }
 
 /*
- * Unzip a zip file.
+ * Returned by CreateTreeFromSpec() for a spec it can't parse.
  */
-func Unzip(zipFilePath string, destinationPath string) error {
-  // https://stackoverflow.com/a/24792688/4004969
-  r, err := zip.OpenReader(zipFilePath)
-  if err != nil {
-    return err
+type TreeSpecError struct {
+  // The 1-based line number of the problem.
+  Line int
+  Reason string
+}
+
+func (err *TreeSpecError) Error() string {
+  return fmt.Sprintf("tree spec line %d: %s", err.Line, err.Reason)
+}
+
+/*
+ * Create files and directories from an indented outline, e.g. for test fixtures.
+ * @param root the directory to create the tree in; it is created if needed
+ * @param spec the outline (see below)
+ * @returns a *TreeSpecError if the spec is malformed, or another error
+ *
+ * Each non-blank line names one entry. A name ending in "/" is a directory, and
+ * the lines under it indented further are its contents; anything else is a file,
+ * which is empty unless the name is followed by ": " and its contents:
+ *
+ *   src/
+ *     main.go: package main\n
+ *     lib/
+ *   README.md: Hello!
+ *
+ * Backslashes escape the next character in names (so "a\: b.txt" is a file
+ * named "a: b.txt" and a leading "\ " keeps a space), and in contents "\n" and
+ * "\t" are a newline and a tab. Trailing whitespace is ignored. Siblings must be
+ * indented the same (spaces or tabs, but consistently), names can't contain "/"
+ * or be "." or "..", and only directories can have children. The whole spec is
+ * checked before anything is created. Existing files are overwritten.
+ */
+func CreateTreeFromSpec(root string, spec string) error {
+  type treeEntry struct {
+    path string
+    isDir bool
+    content string
   }
-  defer func() {
-    if err := r.Close(); err != nil {
-      panic(err)
+  // A directory whose children are being read.
+  type openDir struct {
+    indent string
+    path string
+    childIndent string
+    hasChildren bool
+  }
+  entries := []treeEntry{}
+  stack := []*openDir{{path: ""}}
+  for i, line := range strings.Split(spec, "\n") {
+    lineNumber := i + 1
+    line = strings.TrimRight(line, " \t\r")
+    if line == "" {
+      continue
     }
-  }()
-  err = os.Mkdir(destinationPath, 0755)
+    text := strings.TrimLeft(line, " \t")
+    indent := line[:len(line) - len(text)]
+    // Close the directories this line is no longer inside.
+    for len(stack) > 1 && !(len(indent) > len(stack[len(stack) - 1].indent) && strings.HasPrefix(indent, stack[len(stack) - 1].indent)) {
+      stack = stack[:len(stack) - 1]
+    }
+    parent := stack[len(stack) - 1]
+    if !parent.hasChildren {
+      parent.childIndent = indent
+      parent.hasChildren = true
+    } else if indent != parent.childIndent {
+      reason := "indentation doesn't match the lines before it"
+      if len(indent) > len(parent.childIndent) && strings.HasPrefix(indent, parent.childIndent) {
+        reason = "only directories (names ending in \"/\") can have indented lines under them"
+      }
+      return &TreeSpecError{lineNumber, reason}
+    }
+    name, content, isDir, err := parseTreeSpecLine(text)
+    if err != nil {
+      return &TreeSpecError{lineNumber, err.Error()}
+    }
+    entry := treeEntry{filepath.Join(parent.path, name), isDir, content}
+    entries = append(entries, entry)
+    if isDir {
+      stack = append(stack, &openDir{indent: indent, path: entry.path})
+    }
+  }
+  err := os.MkdirAll(root, 0755)
   if err != nil {
     return err
   }
-  // Closure to address file descriptors issue with all the deferred .Close() methods
-  extractAndWriteFile := func(f *zip.File) error {
-    rc, err := f.Open()
+  for _, entry := range entries {
+    entryPath := filepath.Join(root, entry.path)
+    if entry.isDir {
+      err = os.MkdirAll(entryPath, 0755)
+    } else {
+      err = ioutil.WriteFile(entryPath, []byte(entry.content), 0644)
+    }
     if err != nil {
       return err
     }
-    defer func() {
-      if err := rc.Close(); err != nil {
-        panic(err)
+  }
+  return nil
+}
+
+// Splits a line of a tree spec (without its indentation) into its unescaped name and contents.
+func parseTreeSpecLine(text string) (string, string, bool, error) {
+  name := strings.Builder{}
+  rest := ""
+  isDir := false
+  for i := 0; i < len(text); i++ {
+    c := text[i]
+    if c == '\\' {
+      if i + 1 == len(text) {
+        return "", "", false, errors.New("line ends with a lone backslash")
       }
-    }()
-    path := filepath.Join(destinationPath, f.Name)
-    // Check for ZipSlip (Directory traversal)
-    if !strings.HasPrefix(path, filepath.Clean(destinationPath) + string(os.PathSeparator)) {
-      return fmt.Errorf("illegal file path: %s", path)
+      i++
+      name.WriteByte(text[i])
+      continue
     }
-    if f.FileInfo().IsDir() {
-      os.MkdirAll(path, f.Mode())
-    } else {
-      os.MkdirAll(filepath.Dir(path), f.Mode())
-      f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-      if err != nil {
-        return err
-      }
-      defer func() {
-        if err := f.Close(); err != nil {
-          panic(err)
-        }
-      }()
-      _, err = io.Copy(f, rc)
-      if err != nil {
-        return err
+    if c == ':' && (i + 1 == len(text) || text[i + 1] == ' ') {
+      rest = strings.TrimPrefix(text[i + 1:], " ")
+      break
+    }
+    if c == '/' {
+      if i + 1 != len(text) {
+        return "", "", false, errors.New("\"/\" may only end a directory's name")
       }
+      isDir = true
+      break
     }
-    return nil
+    name.WriteByte(c)
   }
-  for _, f := range r.File {
-    err := extractAndWriteFile(f)
-    if err != nil {
-      return err
+  if name.Len() == 0 {
+    return "", "", false, errors.New("missing name")
+  }
+  if name.String() == "." || name.String() == ".." {
+    return "", "", false, fmt.Errorf("%q isn't allowed as a name", name.String())
+  }
+  content := strings.Builder{}
+  for i := 0; i < len(rest); i++ {
+    c := rest[i]
+    if c != '\\' {
+      content.WriteByte(c)
+      continue
+    }
+    if i + 1 == len(rest) {
+      return "", "", false, errors.New("line ends with a lone backslash")
+    }
+    i++
+    switch rest[i] {
+    case 'n':
+      content.WriteByte('\n')
+    case 't':
+      content.WriteByte('\t')
+    default:
+      content.WriteByte(rest[i])
     }
   }
-  return nil
+  return name.String(), content.String(), isDir, nil
 }
@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+  "os"
+  "syscall"
+)
+
+/*
+ * Guess whether another process has a file locked.
+ * @param filePath the file to check
+ * @returns whether the file appears to be in use, and an error
+ *
+ * This tries a non-blocking flock(), so it only notices processes holding an
+ * advisory lock; merely having the file open isn't detected on these platforms.
+ * The answer is racy: the file may be locked or unlocked right after we look.
+ */
+func IsFileInUse(filePath string) (bool, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return false, err
+  }
+  defer file.Close()
+  err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  if err == syscall.EWOULDBLOCK {
+    return true, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  return false, syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,276 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+  "archive/tar"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+  "unsafe"
+)
+
+/*
+ * Guess whether the file or directory at the given path is stored on an SSD.
+ * @param filePath the path to check
+ * @returns whether the underlying disk is solid state, or ErrSolidStateUnknown
+ *
+ * This reads the "rotational" flag the kernel reports for the block device in
+ * /sys. Paths on virtual filesystems (tmpfs, overlayfs, NFS, ...) and some
+ * device-mapper setups have no single backing disk, so the result is unknown.
+ */
+func IsSolidState(filePath string) (bool, error) {
+  var stat syscall.Stat_t
+  err := syscall.Stat(filePath, &stat)
+  if err != nil {
+    return false, err
+  }
+  dev := uint64(stat.Dev)
+  major := (dev >> 8) & 0xfff | (dev >> 32) & ^uint64(0xfff)
+  minor := dev & 0xff | (dev >> 12) & ^uint64(0xff)
+  if major == 0 {
+    return false, ErrSolidStateUnknown
+  }
+  device, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+  if err != nil {
+    return false, ErrSolidStateUnknown
+  }
+  // Partitions don't have a queue of their own; their parent disk does.
+  for _, dir := range []string{device, filepath.Dir(device)} {
+    data, err := ioutil.ReadFile(filepath.Join(dir, "queue", "rotational"))
+    if os.IsNotExist(err) {
+      continue
+    }
+    if err != nil {
+      return false, ErrSolidStateUnknown
+    }
+    return strings.TrimSpace(string(data)) == "0", nil
+  }
+  return false, ErrSolidStateUnknown
+}
+
+// Sets the size of an open file for AllocateFile(), reserving space with fallocate() if possible.
+func allocateFile(file *os.File, size int64) error {
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  if size > info.Size() {
+    err = syscall.Fallocate(int(file.Fd()), 0, 0, size)
+    if err == nil {
+      return nil
+    }
+    if !errors.Is(err, syscall.EOPNOTSUPP) && !errors.Is(err, syscall.ENOSYS) {
+      return err
+    }
+  }
+  return file.Truncate(size)
+}
+
+/*
+ * Guess whether another process has a file open.
+ * @param filePath the file to check
+ * @returns whether the file appears to be in use, and an error
+ *
+ * This looks through /proc/<pid>/fd for a descriptor referring to the file, and
+ * then tries a non-blocking flock() to catch holders of an advisory lock.
+ * Processes we aren't allowed to inspect (e.g. other users', when not root) are
+ * skipped, so a false result isn't a guarantee. Either way the answer is racy:
+ * the file may be opened or closed right after we look.
+ */
+func IsFileInUse(filePath string) (bool, error) {
+  target, err := os.Stat(filePath)
+  if err != nil {
+    return false, err
+  }
+  self := strconv.Itoa(os.Getpid())
+  procs, err := ioutil.ReadDir("/proc")
+  if err != nil {
+    return false, err
+  }
+  for _, proc := range procs {
+    if proc.Name() == self || strings.Trim(proc.Name(), "0123456789") != "" {
+      continue
+    }
+    fdDir := filepath.Join("/proc", proc.Name(), "fd")
+    fds, err := ioutil.ReadDir(fdDir)
+    if err != nil {
+      continue
+    }
+    for _, fd := range fds {
+      // Stat follows the fd's magic symlink to whatever it has open.
+      info, err := os.Stat(filepath.Join(fdDir, fd.Name()))
+      if err == nil && os.SameFile(info, target) {
+        return true, nil
+      }
+    }
+  }
+  file, err := os.Open(filePath)
+  if err != nil {
+    return false, err
+  }
+  defer file.Close()
+  err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  if err == syscall.EWOULDBLOCK {
+    return true, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  return false, syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// Creates the device or FIFO described by a tar header, for UntarGzWithOptions().
+func makeDevice(filePath string, header *tar.Header) error {
+  mode := uint32(header.Mode & 07777)
+  switch header.Typeflag {
+  case tar.TypeChar:
+    mode |= syscall.S_IFCHR
+  case tar.TypeBlock:
+    mode |= syscall.S_IFBLK
+  default:
+    mode |= syscall.S_IFIFO
+  }
+  major, minor := uint64(header.Devmajor), uint64(header.Devminor)
+  dev := (major & 0xfff) << 8 | (minor & 0xff) | (major &^ 0xfff) << 32 | (minor &^ 0xff) << 12
+  err := syscall.Mknod(filePath, mode, int(dev))
+  if err != nil {
+    return &os.PathError{Op: "mknod", Path: filePath, Err: err}
+  }
+  return nil
+}
+
+/*
+ * Set or clear the immutable flag on a file (like `chattr +i`), so that nobody,
+ * not even root, can modify, rename, delete, or link to it until it's cleared.
+ * @param filePath the file or directory to change
+ * @param immutable whether it should be immutable
+ * @returns an error, including if the process lacks CAP_LINUX_IMMUTABLE (usually: isn't root)
+ *   or the filesystem has no such flag (e.g. tmpfs, NFS)
+ */
+func SetFileImmutable(filePath string, immutable bool) error {
+  const immutableFlag = 0x10 // FS_IMMUTABLE_FL
+  file, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  // The kernel reads and writes an int, whatever size the ioctl numbers claim.
+  var flags int32
+  err = fileFlagsIoctl(file, false, &flags)
+  if err == nil {
+    if immutable {
+      flags |= immutableFlag
+    } else {
+      flags &^= immutableFlag
+    }
+    err = fileFlagsIoctl(file, true, &flags)
+  }
+  switch {
+  case err == syscall.EPERM:
+    return fmt.Errorf("can't change the immutable flag of %s: needs CAP_LINUX_IMMUTABLE (usually root)", filePath)
+  case err == syscall.ENOTTY || err == syscall.EOPNOTSUPP || err == syscall.EINVAL:
+    return fmt.Errorf("the filesystem of %s doesn't support the immutable flag", filePath)
+  case err != nil:
+    return &os.PathError{Op: "ioctl", Path: filePath, Err: err}
+  }
+  return nil
+}
+
+// Does FS_IOC_GETFLAGS or FS_IOC_SETFLAGS, which are _IOR/_IOW('f', 1/2, long).
+func fileFlagsIoctl(file *os.File, set bool, flags *int32) error {
+  // ioctl numbers are laid out differently on a few architectures.
+  read, write, sizeShift, dirShift := uintptr(2), uintptr(1), uintptr(16), uintptr(30)
+  switch runtime.GOARCH {
+  case "mips", "mipsle", "mips64", "mips64le", "ppc64", "ppc64le":
+    read, write, dirShift = 2, 4, 29
+  }
+  request := uintptr('f') << 8 | 1 | read << dirShift
+  if set {
+    request = uintptr('f') << 8 | 2 | write << dirShift
+  }
+  request |= unsafe.Sizeof(uintptr(0)) << sizeShift
+  _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(flags)))
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+// Returns when a file was last read.
+func fileAccessTime(info os.FileInfo) (time.Time, bool) {
+  stat, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return time.Time{}, false
+  }
+  return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)), true
+}
+
+const directIOAlignment = 4096
+
+/*
+ * Copies a file with O_DIRECT for CopyFileWithOptions().
+ * Returns false (and no copy) if the filesystem doesn't support O_DIRECT.
+ */
+func copyFileDirect(inPath string, outPath string) (bool, error) {
+  inFile, err := os.OpenFile(inPath, os.O_RDONLY|syscall.O_DIRECT, 0)
+  if errors.Is(err, syscall.EINVAL) {
+    return false, nil
+  }
+  if err != nil {
+    return true, err
+  }
+  defer inFile.Close()
+  outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_DIRECT, 0666)
+  if errors.Is(err, syscall.EINVAL) {
+    return false, nil
+  }
+  if err != nil {
+    return true, err
+  }
+  defer outFile.Close()
+
+  // O_DIRECT needs the buffer's address, length, and file offset all aligned.
+  raw := make([]byte, 1024 * 1024 + directIOAlignment)
+  shift := directIOAlignment - int(uintptr(unsafe.Pointer(&raw[0])) % directIOAlignment)
+  buffer := raw[shift % directIOAlignment:][:1024 * 1024]
+  offset := int64(0)
+  for {
+    n, err := io.ReadFull(inFile, buffer)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      return true, err
+    }
+    aligned := n - n % directIOAlignment
+    if aligned > 0 {
+      _, writeErr := outFile.Write(buffer[:aligned])
+      if writeErr != nil {
+        return true, wrapDiskFull(outPath, writeErr)
+      }
+      offset += int64(aligned)
+    }
+    if aligned < n {
+      // The tail isn't a whole block, so write it through a normal descriptor.
+      tailFile, err := os.OpenFile(outPath, os.O_WRONLY, 0)
+      if err != nil {
+        return true, err
+      }
+      _, err = tailFile.WriteAt(buffer[aligned:n], offset)
+      if closeErr := tailFile.Close(); err == nil {
+        err = closeErr
+      }
+      return true, wrapDiskFull(outPath, err)
+    }
+    if n < len(buffer) {
+      return true, nil
+    }
+  }
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+  "os"
+  "syscall"
+)
+
+// Tries to take an exclusive flock() on lockPath (creating it if needed) without
+// waiting. Returns a nil unlock function if another holder has it. The kernel
+// drops the lock if this process dies, so the file is left in place.
+func tryLockFile(lockPath string) (func(), error) {
+  file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  if err == syscall.EWOULDBLOCK {
+    file.Close()
+    return nil, nil
+  }
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+  return func() {
+    syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+    file.Close()
+  }, nil
+}
@@ -0,0 +1,39 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// Tries to create lockPath (holding our PID) without waiting. Returns a nil unlock
+// function if another holder has it. Without flock() the lock outlives a crashed
+// holder, so a lock file whose PID is no longer running is deleted and retried.
+// Two processes clearing the same stale lock at once can race, so this is weaker
+// than the flock() version.
+func tryLockFile(lockPath string) (func(), error) {
+  err := CreateExclusive(lockPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+  if err == nil {
+    return func() { os.Remove(lockPath) }, nil
+  }
+  if err != ErrAlreadyExists {
+    return nil, err
+  }
+  data, err := ioutil.ReadFile(lockPath)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil, nil
+    }
+    return nil, err
+  }
+  pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+  if err == nil && !processRunning(pid) {
+    os.Remove(lockPath)
+  }
+  return nil, nil
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import (
+  "os"
+)
+
+/*
+ * Guess whether another process has a file open.
+ * @param filePath the file to check
+ * @returns whether the file appears to be in use, and an error
+ *
+ * Only Linux, Windows, macOS, and the BSDs are supported; elsewhere this returns
+ * ErrInUseUnknown (or an error if the file doesn't exist).
+ */
+func IsFileInUse(filePath string) (bool, error) {
+  _, err := os.Stat(filePath)
+  if err != nil {
+    return false, err
+  }
+  return false, ErrInUseUnknown
+}
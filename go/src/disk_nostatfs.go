@@ -0,0 +1,17 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package main
+
+/*
+ * Count the free and total inodes of the filesystem a path is on.
+ * @param filePath any path on the filesystem
+ * @returns (free inodes, total inodes, error)
+ *
+ * Inode counts are only reported on Linux, macOS, and FreeBSD. Elsewhere (e.g. on
+ * Windows, whose filesystems have no fixed inode table) this returns (0, 0, nil),
+ * meaning "no fixed limit / unknown".
+ */
+func FreeInodes(filePath string) (uint64, uint64, error) {
+  return 0, 0, nil
+}
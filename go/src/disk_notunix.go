@@ -0,0 +1,28 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package main
+
+import (
+  "os"
+)
+
+// Returns the owner of a file, if the platform has such a thing.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+  return 0, 0, false
+}
+
+func isDiskFullErrno(err error) bool {
+  return false
+}
+
+// Returns the ID of the device (filesystem) a file is on, if the platform reports one.
+func deviceID(info os.FileInfo) (uint64, bool) {
+  return 0, false
+}
+
+// Reports whether a process with this PID exists. There's no way to check here,
+// so it's assumed to be.
+func processRunning(pid int) bool {
+  return true
+}
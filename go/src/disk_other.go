@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+  "archive/tar"
+  "errors"
+  "os"
+  "time"
+)
+
+/*
+ * Guess whether the file or directory at the given path is stored on an SSD.
+ * @param filePath the path to check
+ * @returns whether the underlying disk is solid state, or ErrSolidStateUnknown
+ *
+ * Only Linux is supported; on other platforms this always returns ErrSolidStateUnknown.
+ */
+func IsSolidState(filePath string) (bool, error) {
+  return false, ErrSolidStateUnknown
+}
+
+// O_DIRECT is Linux-only, so CopyFileWithOptions() always does a normal copy.
+func copyFileDirect(inPath string, outPath string) (bool, error) {
+  return false, nil
+}
+
+// fallocate() is Linux-only, so AllocateFile() just sets the file's size.
+func allocateFile(file *os.File, size int64) error {
+  return file.Truncate(size)
+}
+
+// Devices are only extracted on Linux, where mknod's device numbers are well known.
+func makeDevice(filePath string, header *tar.Header) error {
+  return errors.New("devices and FIFOs can only be extracted on Linux")
+}
+
+/*
+ * Set or clear the immutable flag on a file (like `chattr +i`).
+ * @param filePath the file or directory to change
+ * @param immutable whether it should be immutable
+ * @returns an error; only Linux is supported, so on other platforms this always fails
+ */
+func SetFileImmutable(filePath string, immutable bool) error {
+  return errors.New("immutable files are only supported on Linux")
+}
+
+// Access times are only read on Linux, where Stat_t's layout is known.
+func fileAccessTime(info os.FileInfo) (time.Time, bool) {
+  return time.Time{}, false
+}
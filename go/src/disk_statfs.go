@@ -0,0 +1,32 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import (
+  "syscall"
+)
+
+/*
+ * Count the free and total inodes of the filesystem a path is on.
+ * @param filePath any path on the filesystem
+ * @returns (free inodes, total inodes, error)
+ *
+ * Filesystems with lots of tiny files can run out of inodes while plenty of bytes
+ * are free, so check this before e.g. extracting an archive of many small files.
+ * Some filesystems (e.g. btrfs) allocate inodes dynamically and report a total of 0;
+ * treat (0, 0, nil) as "no fixed limit / unknown".
+ */
+func FreeInodes(filePath string) (uint64, uint64, error) {
+  var stat syscall.Statfs_t
+  err := syscall.Statfs(filePath, &stat)
+  if err != nil {
+    return 0, 0, err
+  }
+  // Ffree is signed on some platforms.
+  free := int64(stat.Ffree)
+  if free < 0 {
+    free = 0
+  }
+  return uint64(free), uint64(stat.Files), nil
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// A tar entry for writeTarGz(). Names ending in "/" are directories.
+type tarEntry struct {
+  name string
+  linkname string
+  typeflag byte
+  mode int64
+  body string
+}
+
+func writeTarGz(t *testing.T, archivePath string, entries []tarEntry) {
+  file, err := os.Create(archivePath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  gzipWriter := gzip.NewWriter(file)
+  tarWriter := tar.NewWriter(gzipWriter)
+  for _, entry := range entries {
+    header := &tar.Header{Name: entry.name, Linkname: entry.linkname, Typeflag: entry.typeflag, Mode: entry.mode, Size: int64(len(entry.body))}
+    if header.Mode == 0 {
+      header.Mode = 0644
+    }
+    err = tarWriter.WriteHeader(header)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = tarWriter.Write([]byte(entry.body))
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err = tarWriter.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if err = gzipWriter.Close(); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestUntarGzRejectsSymlinkEscapes(t *testing.T) {
+  tests := []struct {
+    name string
+    entries []tarEntry
+  }{
+    {"chained symlinks", []tarEntry{
+      {name: "l1", linkname: ".", typeflag: tar.TypeSymlink},
+      {name: "l2", linkname: "l1/..", typeflag: tar.TypeSymlink},
+      {name: "l2/evildir/", typeflag: tar.TypeDir, mode: 0777},
+      {name: "l2/victim/", typeflag: tar.TypeDir, mode: 0777},
+    }},
+    {"dot-dot after a symlink", []tarEntry{
+      {name: "d/", typeflag: tar.TypeDir, mode: 0755},
+      {name: "d/up", linkname: "..", typeflag: tar.TypeSymlink},
+      {name: "d/out", linkname: "up/..", typeflag: tar.TypeSymlink},
+      {name: "d/out/evil.txt", typeflag: tar.TypeReg, body: "evil"},
+    }},
+    {"dot-dot after a missing component", []tarEntry{
+      {name: "d/", typeflag: tar.TypeDir, mode: 0755},
+      {name: "d/out", linkname: "later/../..", typeflag: tar.TypeSymlink},
+      {name: "d/later", linkname: "..", typeflag: tar.TypeSymlink},
+      {name: "d/out/evil.txt", typeflag: tar.TypeReg, body: "evil"},
+    }},
+    {"absolute symlink", []tarEntry{
+      {name: "abs", linkname: "/tmp", typeflag: tar.TypeSymlink},
+    }},
+    {"dot-dot path", []tarEntry{
+      {name: "../evil.txt", typeflag: tar.TypeReg, body: "evil"},
+    }},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      root := t.TempDir()
+      victim := filepath.Join(root, "victim")
+      err := os.Mkdir(victim, 0700)
+      if err != nil {
+        t.Fatal(err)
+      }
+      archivePath := filepath.Join(root, "evil.tar.gz")
+      writeTarGz(t, archivePath, test.entries)
+      err = UntarGz(archivePath, filepath.Join(root, "dest"))
+      if err == nil {
+        t.Error("extracted without an error")
+      }
+      for _, name := range []string{"evildir", "evil.txt"} {
+        if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+          t.Errorf("%s was created outside the destination", name)
+        }
+      }
+      info, err := os.Stat(victim)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if info.Mode().Perm() != 0700 {
+        t.Errorf("victim's mode changed to %o", info.Mode().Perm())
+      }
+    })
+  }
+}
+
+func TestUntarGzKeepsInternalSymlinks(t *testing.T) {
+  root := t.TempDir()
+  archivePath := filepath.Join(root, "ok.tar.gz")
+  writeTarGz(t, archivePath, []tarEntry{
+    {name: "a/", typeflag: tar.TypeDir, mode: 0755},
+    {name: "a/b/", typeflag: tar.TypeDir, mode: 0700},
+    {name: "a/file.txt", typeflag: tar.TypeReg, body: "hi"},
+    {name: "a/b/up", linkname: "../file.txt", typeflag: tar.TypeSymlink},
+    {name: "link", linkname: "a/b", typeflag: tar.TypeSymlink},
+    {name: "link/inner.txt", typeflag: tar.TypeReg, body: "inner"},
+  })
+  dest := filepath.Join(root, "dest")
+  err := UntarGz(archivePath, dest)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := os.ReadFile(filepath.Join(dest, "a/b/up"))
+  if err != nil || string(data) != "hi" {
+    t.Errorf("a/b/up = %q, %v", data, err)
+  }
+  data, err = os.ReadFile(filepath.Join(dest, "a/b/inner.txt"))
+  if err != nil || string(data) != "inner" {
+    t.Errorf("a/b/inner.txt = %q, %v", data, err)
+  }
+  info, err := os.Stat(filepath.Join(dest, "a/b"))
+  if err != nil || info.Mode().Perm() != 0700 {
+    t.Errorf("a/b mode = %v, %v", info.Mode(), err)
+  }
+}
+
+func TestUntarGzStripComponents(t *testing.T) {
+  root := t.TempDir()
+  archivePath := filepath.Join(root, "strip.tar.gz")
+  writeTarGz(t, archivePath, []tarEntry{
+    {name: "project-1.0/", typeflag: tar.TypeDir, mode: 0755},
+    {name: "project-1.0/src/a.go", typeflag: tar.TypeReg, body: "package a"},
+    {name: "project-1.0/src/b.go", linkname: "project-1.0/src/a.go", typeflag: tar.TypeLink},
+    {name: "README", typeflag: tar.TypeReg, body: "skipped"},
+  })
+  dest := filepath.Join(root, "dest")
+  err := UntarGzWithOptions(archivePath, dest, UntarOptions{StripComponents: 1})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, name := range []string{"src/a.go", "src/b.go"} {
+    data, err := os.ReadFile(filepath.Join(dest, name))
+    if err != nil || string(data) != "package a" {
+      t.Errorf("%s = %q, %v", name, data, err)
+    }
+  }
+  for _, name := range []string{"README", "project-1.0"} {
+    if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+      t.Errorf("%s should have been stripped away: %v", name, err)
+    }
+  }
+}
+
+func TestUntarGzMaxDepth(t *testing.T) {
+  root := t.TempDir()
+  archivePath := filepath.Join(root, "deep.tar.gz")
+  writeTarGz(t, archivePath, []tarEntry{
+    {name: "top/a/b.txt", typeflag: tar.TypeReg, body: "ok"},
+    {name: "top/a/b/c.txt", typeflag: tar.TypeReg, body: "too deep"},
+  })
+  err := UntarGzWithOptions(archivePath, filepath.Join(root, "ok"), UntarOptions{StripComponents: 1, MaxDepth: 3})
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = UntarGzWithOptions(archivePath, filepath.Join(root, "deep"), UntarOptions{MaxDepth: 3})
+  var limitErr *PathLimitError
+  if !errors.As(err, &limitErr) || limitErr.Name != "top/a/b/c.txt" {
+    t.Fatalf("expected a *PathLimitError for top/a/b/c.txt, got %v", err)
+  }
+}
+
+// Every path through copyFileWithOptions() must carry the source's permissions over.
+func TestCopyDirWithOptionsKeepsMode(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("Windows only has a read-only bit")
+  }
+  src := filepath.Join(t.TempDir(), "src")
+  err := os.MkdirAll(src, 0755)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for name, data := range map[string]string{"run.sh": "echo hi\r\n", "bin": "\x00\x01\x02"} {
+    err = os.WriteFile(filepath.Join(src, name), []byte(data), 0644)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, name := range []string{"run.sh", "bin"} {
+    err = os.Chmod(filepath.Join(src, name), 0750)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  // A symlink is copied as its target, so the copy gets the target's mode.
+  err = os.Symlink("run.sh", filepath.Join(src, "link"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, conversion := range []LineEndingConversion{LineEndingNone, LineEndingToLF} {
+    dst := filepath.Join(t.TempDir(), "dst")
+    _, err = CopyDirWithOptions(src, dst, CopyDirOptions{LineEndingConversion: conversion})
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, name := range []string{"run.sh", "bin", "link"} {
+      info, err := os.Stat(filepath.Join(dst, name))
+      if err != nil {
+        t.Fatal(err)
+      }
+      if info.Mode().Perm() != 0750 {
+        t.Errorf("conversion %d: %s has mode %v, want 0750", conversion, name, info.Mode().Perm())
+      }
+    }
+  }
+}
+
+func TestCopyDirAdaptiveKeepsMode(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("Windows only has a read-only bit")
+  }
+  src := filepath.Join(t.TempDir(), "src")
+  err := CreateTreeFromSpec(src, "run.sh: echo hi\nprivate/\n  a.txt\nreadonly/\n  b.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Symlink("run.sh", filepath.Join(src, "link"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  modes := map[string]os.FileMode{"run.sh": 0750, "private/a.txt": 0600, "private": 0700, "readonly": 0555, "link": 0750}
+  for _, name := range []string{"run.sh", "private/a.txt", "private", "readonly"} {
+    err = os.Chmod(filepath.Join(src, name), modes[name])
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  dst := filepath.Join(t.TempDir(), "dst")
+  // Let the read-only directories be cleaned up.
+  t.Cleanup(func() {
+    os.Chmod(filepath.Join(src, "readonly"), 0755)
+    os.Chmod(filepath.Join(dst, "readonly"), 0755)
+  })
+  _, err = CopyDirAdaptiveWithOptions(src, dst, AdaptiveCopyOptions{Workers: 2, SampleFiles: 1})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for name, want := range modes {
+    info, err := os.Stat(filepath.Join(dst, name))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if info.Mode().Perm() != want {
+      t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), want)
+    }
+  }
+}
+
+// A manifest is untrusted input, so it must not change anything outside dirPath.
+func TestRestoreDirMetadataStaysInside(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("Windows only has a read-only bit")
+  }
+  root := t.TempDir()
+  dirPath := filepath.Join(root, "dir")
+  outside := filepath.Join(root, "outside")
+  err := CreateTreeFromSpec(root, "dir/\n  inner.txt\noutside/\n  secret.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Symlink(outside, filepath.Join(dirPath, "link"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    paths []string
+  }{
+    {"parent", []string{"inner.txt", "../outside/secret.txt"}},
+    {"sibling", []string{"../outside"}},
+    {"hidden climb", []string{"a/../../outside"}},
+    {"absolute", []string{outside}},
+    {"through symlink", []string{"link/secret.txt"}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      entries := []string{}
+      for _, entryPath := range test.paths {
+        entries = append(entries, fmt.Sprintf(`{"Path":%q,"Mode":511}`, filepath.ToSlash(entryPath)))
+      }
+      manifestPath := filepath.Join(root, "manifest.json")
+      err := os.WriteFile(manifestPath, []byte("[" + strings.Join(entries, ",") + "]"), 0644)
+      if err != nil {
+        t.Fatal(err)
+      }
+      err = RestoreDirMetadata(dirPath, manifestPath)
+      if !errors.Is(err, ErrEscapesRoot) {
+        t.Errorf("expected ErrEscapesRoot, got %v", err)
+      }
+      for _, filePath := range []string{outside, filepath.Join(outside, "secret.txt"), filepath.Join(dirPath, "inner.txt")} {
+        info, err := os.Stat(filePath)
+        if err != nil {
+          t.Fatal(err)
+        }
+        if info.Mode().Perm() == 0777 {
+          t.Errorf("%s was changed to %v", filePath, info.Mode().Perm())
+        }
+      }
+    })
+  }
+  // A manifest SaveDirManifest() wrote still restores.
+  manifestPath := filepath.Join(root, "saved.json")
+  err = SaveDirManifest(dirPath, manifestPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Chmod(filepath.Join(dirPath, "inner.txt"), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = RestoreDirMetadata(dirPath, manifestPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  info, err := os.Stat(filepath.Join(dirPath, "inner.txt"))
+  if err != nil || info.Mode().Perm() != 0644 {
+    t.Errorf("inner.txt wasn't restored: %v, %v", info, err)
+  }
+}
+
+func TestCopyDirToTempCurrentDirectory(t *testing.T) {
+  srcPath := filepath.Join(t.TempDir(), "project")
+  err := CreateTreeFromSpec(srcPath, "a.txt: hi")
+  if err != nil {
+    t.Fatal(err)
+  }
+  workingDir, err := os.Getwd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Chdir(srcPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { os.Chdir(workingDir) })
+  copyPath, cleanup, err := CopyDirToTemp(".")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer cleanup()
+  if filepath.Base(copyPath) != "project" {
+    t.Errorf("copy is at %s, want it named project", copyPath)
+  }
+  data, err := os.ReadFile(filepath.Join(copyPath, "a.txt"))
+  if err != nil || string(data) != "hi" {
+    t.Errorf("a.txt = %q, %v", data, err)
+  }
+}
+
+// A record for packRecords(), in UnpackDir()'s format.
+type packRecord struct {
+  name string
+  mode os.FileMode
+  size uint64
+  data string
+}
+
+func packRecords(records []packRecord) *bytes.Buffer {
+  buffer := bytes.NewBufferString(packMagic)
+  for _, record := range records {
+    binary.Write(buffer, binary.BigEndian, uint16(len(record.name)))
+    buffer.WriteString(record.name)
+    binary.Write(buffer, binary.BigEndian, uint32(record.mode))
+    binary.Write(buffer, binary.BigEndian, record.size)
+    buffer.WriteString(record.data)
+  }
+  return buffer
+}
+
+func TestUnpackDirRejectsSymlinkEscapes(t *testing.T) {
+  root := t.TempDir()
+  stream := packRecords([]packRecord{
+    {"l1", os.ModeSymlink | 0777, 1, "."},
+    {"l2", os.ModeSymlink | 0777, 5, "l1/.."},
+    {"l2/evil.txt", 0644, 4, "evil"},
+  })
+  err := UnpackDir(stream, filepath.Join(root, "dest"))
+  if err == nil {
+    t.Error("unpacked without an error")
+  }
+  if _, err := os.Lstat(filepath.Join(root, "evil.txt")); err == nil {
+    t.Error("evil.txt was written outside the destination")
+  }
+}
+
+func TestUnpackDirRejectsHugeSymlinkTarget(t *testing.T) {
+  stream := packRecords([]packRecord{
+    {"link", os.ModeSymlink | 0777, 1 << 62, ""},
+  })
+  err := UnpackDir(stream, filepath.Join(t.TempDir(), "dest"))
+  if err == nil {
+    t.Error("unpacked without an error")
+  }
+}
+
+func TestUnpackDirRoundTrip(t *testing.T) {
+  root := t.TempDir()
+  src := filepath.Join(root, "src")
+  err := CreateTreeFromSpec(src, "a/\n  b.txt: hello\n  c/\n")
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Symlink(filepath.Join("..", "b.txt"), filepath.Join(src, "a", "c", "up"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  buffer := &bytes.Buffer{}
+  err = PackDir(src, buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dest := filepath.Join(root, "dest")
+  err = UnpackDir(buffer, dest)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := os.ReadFile(filepath.Join(dest, "a", "c", "up"))
+  if err != nil || string(data) != "hello" {
+    t.Errorf("a/c/up = %q, %v", data, err)
+  }
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+  tests := []struct {
+    patterns []string
+    path string
+    isDir bool
+    want bool
+  }{
+    // Names without a slash match at any depth.
+    {[]string{"*.log"}, "debug.log", false, true},
+    {[]string{"*.log"}, "logs/debug.log", false, true},
+    {[]string{"*.log"}, "debug.logx", false, false},
+    {[]string{"debug?.log"}, "debug1.log", false, true},
+    {[]string{"debug[0-9].log"}, "debuga.log", false, false},
+    // A leading slash, or any inner slash, anchors to the root.
+    {[]string{"/debug.log"}, "debug.log", false, true},
+    {[]string{"/debug.log"}, "logs/debug.log", false, false},
+    {[]string{"logs/debug.log"}, "logs/debug.log", false, true},
+    {[]string{"logs/debug.log"}, "build/logs/debug.log", false, false},
+    // A trailing slash only matches directories.
+    {[]string{"build/"}, "build", true, true},
+    {[]string{"build/"}, "build", false, false},
+    {[]string{"build/"}, "src/build", true, true},
+    {[]string{"/build/"}, "src/build", true, false},
+    // "**"
+    {[]string{"**/logs"}, "logs", true, true},
+    {[]string{"**/logs"}, "a/b/logs", true, true},
+    {[]string{"**/logs/debug.log"}, "a/logs/debug.log", false, true},
+    {[]string{"logs/**/debug.log"}, "logs/debug.log", false, true},
+    {[]string{"logs/**/debug.log"}, "logs/a/b/debug.log", false, true},
+    {[]string{"logs/**/debug.log"}, "other/a/debug.log", false, false},
+    {[]string{"logs/**"}, "logs/a/debug.log", false, true},
+    {[]string{"logs/**"}, "logs", true, false},
+    // Negation: the last matching pattern wins.
+    {[]string{"*.log", "!important.log"}, "important.log", false, false},
+    {[]string{"*.log", "!important.log"}, "debug.log", false, true},
+    {[]string{"!important.log", "*.log"}, "important.log", false, true},
+    {[]string{"*.log", "!important/*.log", "important/trace.log"}, "important/trace.log", false, true},
+    {[]string{"*.log", "!important/*.log", "important/trace.log"}, "important/debug.log", false, false},
+    // Comments, blank lines, and escapes.
+    {[]string{"# comment", "", "   "}, "# comment", false, false},
+    {[]string{"\\#file"}, "#file", false, true},
+    {[]string{"\\!file"}, "!file", false, true},
+    {[]string{"trailing   "}, "trailing", false, true},
+  }
+  for _, test := range tests {
+    got := newIgnoreMatcher(test.patterns).match(test.path, test.isDir)
+    if got != test.want {
+      t.Errorf("patterns %q, path %q (dir %v): ignored = %v, want %v", test.patterns, test.path, test.isDir, got, test.want)
+    }
+  }
+}
+
+func TestChildrenOfDirIgnoringNegation(t *testing.T) {
+  root := t.TempDir()
+  err := CreateTreeFromSpec(root, "a.log\nkeep.log\nbuild/\n  out.log\nsrc/\n  main.go\n")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Ignoring build/ means build/out.log can't be re-included.
+  children, err := ChildrenOfDirIgnoring(root, []string{"*.log", "!keep.log", "build/", "!build/out.log"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := strings.Join(children, ",")
+  want := strings.Join([]string{"keep.log", "src", filepath.Join("src", "main.go")}, ",")
+  if got != want {
+    t.Errorf("got %s, want %s", got, want)
+  }
+}
+
+// A zip entry for writeZip().
+type zipEntry struct {
+  name string
+  mode os.FileMode
+  body string
+}
+
+func writeZip(t *testing.T, zipFilePath string, entries []zipEntry) {
+  file, err := os.Create(zipFilePath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  zipWriter := zip.NewWriter(file)
+  for _, entry := range entries {
+    header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+    if entry.mode != 0 {
+      header.SetMode(entry.mode)
+    }
+    w, err := zipWriter.CreateHeader(header)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = w.Write([]byte(entry.body))
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err = zipWriter.Close(); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestUnzipRejectsZipSlip(t *testing.T) {
+  for _, name := range []string{"../evil.txt", "a/../../evil.txt", "a/b/../../../evil.txt"} {
+    t.Run(name, func(t *testing.T) {
+      root := t.TempDir()
+      zipFilePath := filepath.Join(root, "evil.zip")
+      writeZip(t, zipFilePath, []zipEntry{{name: "ok.txt", body: "ok"}, {name: name, body: "evil"}})
+      err := Unzip(zipFilePath, filepath.Join(root, "dest"))
+      if err == nil {
+        t.Error("extracted without an error")
+      }
+      if _, err := os.Lstat(filepath.Join(root, "evil.txt")); err == nil {
+        t.Error("evil.txt was written outside the destination")
+      }
+      // Every entry is checked before anything is written.
+      if _, err := os.Lstat(filepath.Join(root, "dest", "ok.txt")); err == nil {
+        t.Error("ok.txt was extracted before the bad entry was found")
+      }
+    })
+  }
+}
+
+func TestUnzipKeepsAbsolutePathsInside(t *testing.T) {
+  root := t.TempDir()
+  zipFilePath := filepath.Join(root, "abs.zip")
+  outside := filepath.Join(root, "outside.txt")
+  writeZip(t, zipFilePath, []zipEntry{{name: filepath.ToSlash(outside), body: "abs"}})
+  dest := filepath.Join(root, "dest")
+  err := Unzip(zipFilePath, dest)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := os.Lstat(outside); err == nil {
+    t.Error("an absolute entry was written to its absolute path")
+  }
+  data, err := os.ReadFile(filepath.Join(dest, outside))
+  if err != nil || string(data) != "abs" {
+    t.Errorf("absolute entry inside dest = %q, %v", data, err)
+  }
+}
+
+func TestUnzipDoesNotCreateSymlinks(t *testing.T) {
+  root := t.TempDir()
+  zipFilePath := filepath.Join(root, "link.zip")
+  writeZip(t, zipFilePath, []zipEntry{
+    {name: "link", mode: os.ModeSymlink | 0777, body: "../../.."},
+    {name: "link/evil.txt", body: "evil"},
+  })
+  dest := filepath.Join(root, "dest")
+  // "link" is extracted as a regular file, so "link/evil.txt" can't be created under it.
+  Unzip(zipFilePath, dest)
+  info, err := os.Lstat(filepath.Join(dest, "link"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if info.Mode()&os.ModeSymlink != 0 {
+    t.Error("a symlink entry was extracted as a symlink")
+  }
+  if _, err := os.Lstat(filepath.Join(root, "evil.txt")); err == nil {
+    t.Error("evil.txt was written outside the destination")
+  }
+}
+
+func TestUnzipCaseCollisions(t *testing.T) {
+  root := t.TempDir()
+  zipFilePath := filepath.Join(root, "case.zip")
+  writeZip(t, zipFilePath, []zipEntry{{name: "README.md", body: "1"}, {name: "readme.md", body: "2"}})
+  err := UnzipWithOptions(zipFilePath, filepath.Join(root, "error"), UnzipOptions{CaseCollisions: CaseCollisionError})
+  if !errors.Is(err, ErrCaseCollision) {
+    t.Errorf("CaseCollisionError: got %v", err)
+  }
+  dest := filepath.Join(root, "rename")
+  err = UnzipWithOptions(zipFilePath, dest, UnzipOptions{CaseCollisions: CaseCollisionRename})
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := os.ReadFile(filepath.Join(dest, "readme_2.md"))
+  if err != nil || string(data) != "2" {
+    t.Errorf("readme_2.md = %q, %v", data, err)
+  }
+  collisions, err := DetectCaseCollisions(zipFilePath)
+  if err != nil || len(collisions) != 1 || len(collisions[0]) != 2 {
+    t.Errorf("DetectCaseCollisions = %v, %v", collisions, err)
+  }
+}
+
+// A rotation that can't shift the backups must not lose writes, and the next
+// write must retry the rotation once the obstacle is gone.
+func TestRotatingFileSurvivesFailedRotation(t *testing.T) {
+  logPath := filepath.Join(t.TempDir(), "log")
+  rotatingFile, err := NewRotatingFile(logPath, 8, 1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer rotatingFile.Close()
+  _, err = rotatingFile.Write([]byte("first\n"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  // A non-empty directory where the oldest backup goes can't be removed.
+  err = os.MkdirAll(filepath.Join(logPath + ".1", "blocker"), 0755)
+  if err != nil {
+    t.Fatal(err)
+  }
+  n, err := rotatingFile.Write([]byte("second\n"))
+  if err != nil || n != len("second\n") {
+    t.Fatalf("write during the failed rotation = %d, %v", n, err)
+  }
+  if rotatingFile.RotationError() == nil {
+    t.Fatal("expected the rotation to fail")
+  }
+  err = os.RemoveAll(logPath + ".1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  _, err = rotatingFile.Write([]byte("third\n"))
+  if err != nil {
+    t.Fatalf("write after the failed rotation: %v", err)
+  }
+  if err = rotatingFile.RotationError(); err != nil {
+    t.Errorf("RotationError() after a successful rotation = %v", err)
+  }
+  for filePath, want := range map[string]string{logPath: "third\n", logPath + ".1": "first\nsecond\n"} {
+    got, err := os.ReadFile(filePath)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if string(got) != want {
+      t.Errorf("%s = %q, want %q", filePath, got, want)
+    }
+  }
+}
+
+func TestUpdateJSONFileConcurrent(t *testing.T) {
+  filePath := filepath.Join(t.TempDir(), "counter.json")
+  // A lock file left behind by a holder that died must not block anyone.
+  err := os.WriteFile(filePath + ".lock", []byte("999999999\n"), 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+  group := sync.WaitGroup{}
+  errs := make(chan error, 20)
+  for i := 0; i < 20; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      errs <- UpdateJSONFile(filePath, func(count int) (int, error) {
+        return count + 1, nil
+      })
+    }()
+  }
+  group.Wait()
+  close(errs)
+  for err := range errs {
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  data, err := os.ReadFile(filePath)
+  if err != nil || string(data) != "20" {
+    t.Errorf("counter = %q, %v, want 20", data, err)
+  }
+}
+
+// Makes a file of the given size for a benchmark.
+func benchmarkFile(b *testing.B, size int) string {
+  filePath := filepath.Join(b.TempDir(), "src")
+  err := os.WriteFile(filePath, bytes.Repeat([]byte("0123456789abcdef"), size / 16), 0644)
+  if err != nil {
+    b.Fatal(err)
+  }
+  return filePath
+}
+
+// Compares the cost of each SyncMode on a 64 MB copy. The temporary directory is
+// usually on the OS's temp disk; set TMPDIR to benchmark another one (on tmpfs,
+// fsync is free and the modes tie).
+func BenchmarkCopyFileSyncMode(b *testing.B) {
+  modes := []struct {
+    name string
+    options CopyFileOptions
+  }{
+    {"NoSync", CopyFileOptions{SyncMode: NoSync}},
+    {"SyncOnClose", CopyFileOptions{SyncMode: SyncOnClose}},
+    {"SyncEveryNBytes", CopyFileOptions{SyncMode: SyncEveryNBytes, SyncEveryBytes: 8 << 20}},
+  }
+  srcPath := benchmarkFile(b, 64 << 20)
+  for _, mode := range modes {
+    b.Run(mode.name, func(b *testing.B) {
+      dstPath := filepath.Join(b.TempDir(), "dst")
+      b.SetBytes(64 << 20)
+      for i := 0; i < b.N; i++ {
+        err := CopyFileWithOptions(srcPath, dstPath, mode.options)
+        if err != nil {
+          b.Fatal(err)
+        }
+      }
+    })
+  }
+}
+
+// Copies file to file through plain Readers and Writers, so io.CopyBuffer really
+// uses the buffer instead of letting the OS copy (copy_file_range, sendfile).
+func copyThroughBuffer(srcPath string, dstPath string, bufferSize int) error {
+  in, err := os.Open(srcPath)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  out, err := os.Create(dstPath)
+  if err != nil {
+    return err
+  }
+  defer out.Close()
+  _, err = io.CopyBuffer(struct{ io.Writer }{out}, struct{ io.Reader }{in}, make([]byte, bufferSize))
+  return err
+}
+
+// Compares OptimalCopyBuffer()'s choice against fixed buffer sizes, for files
+// around its thresholds (256 KB, where it stops reading files in one go, and
+// 256 MB, where 1/64th of the size reaches the 4 MB cap).
+func BenchmarkOptimalCopyBuffer(b *testing.B) {
+  for _, fileSize := range []int{16 << 10, 256 << 10, 4 << 20, 64 << 20, 256 << 20} {
+    srcPath := benchmarkFile(b, fileSize)
+    dstPath := filepath.Join(b.TempDir(), "dst")
+    optimal := OptimalCopyBuffer(int64(fileSize))
+    bufferSizes := []int{optimal}
+    for _, bufferSize := range []int{32 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20} {
+      if bufferSize != optimal {
+        bufferSizes = append(bufferSizes, bufferSize)
+      }
+    }
+    for _, bufferSize := range bufferSizes {
+      name := fmt.Sprintf("file=%dKB/buffer=%dKB", fileSize >> 10, bufferSize >> 10)
+      if bufferSize == optimal {
+        name += "(optimal)"
+      }
+      b.Run(name, func(b *testing.B) {
+        b.SetBytes(int64(fileSize))
+        for i := 0; i < b.N; i++ {
+          err := copyThroughBuffer(srcPath, dstPath, bufferSize)
+          if err != nil {
+            b.Fatal(err)
+          }
+        }
+      })
+    }
+  }
+}
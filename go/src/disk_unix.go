@@ -0,0 +1,38 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+// Returns the owner of a file, if the platform has such a thing.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+  stat, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, 0, false
+  }
+  return int(stat.Uid), int(stat.Gid), true
+}
+
+func isDiskFullErrno(err error) bool {
+  return errors.Is(err, syscall.ENOSPC)
+}
+
+// Returns the ID of the device (filesystem) a file is on, if the platform reports one.
+func deviceID(info os.FileInfo) (uint64, bool) {
+  stat, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, false
+  }
+  return uint64(stat.Dev), true
+}
+
+// Reports whether a process with this PID exists (signal 0 only checks).
+func processRunning(pid int) bool {
+  err := syscall.Kill(pid, 0)
+  return err == nil || err == syscall.EPERM
+}
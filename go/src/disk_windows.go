@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+// Returns the owner of a file, if the platform has such a thing.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+  return 0, 0, false
+}
+
+func isDiskFullErrno(err error) bool {
+  const errorHandleDiskFull = 39
+  const errorDiskFull = 112
+  var errno syscall.Errno
+  return errors.As(err, &errno) && (errno == errorHandleDiskFull || errno == errorDiskFull)
+}
+
+// Returns the ID of the device (filesystem) a file is on, if the platform reports one.
+func deviceID(info os.FileInfo) (uint64, bool) {
+  return 0, false
+}
+
+/*
+ * Guess whether another process has a file open.
+ * @param filePath the file to check
+ * @returns whether the file appears to be in use, and an error
+ *
+ * This opens the file without sharing any access (share mode 0), which Windows
+ * refuses with a sharing violation while anyone else has it open. The probe's
+ * handle is closed straight away, but the answer is still racy: the file may be
+ * opened or closed right after we look.
+ */
+func IsFileInUse(filePath string) (bool, error) {
+  const errorSharingViolation = 32
+  path, err := syscall.UTF16PtrFromString(filePath)
+  if err != nil {
+    return false, err
+  }
+  handle, err := syscall.CreateFile(path, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+  if err == syscall.Errno(errorSharingViolation) {
+    return true, nil
+  }
+  if err != nil {
+    return false, &os.PathError{Op: "open", Path: filePath, Err: err}
+  }
+  return false, syscall.CloseHandle(handle)
+}
+
+// Reports whether a process with this PID exists.
+func processRunning(pid int) bool {
+  // FindProcess opens a handle to the process, which fails if it has exited.
+  process, err := os.FindProcess(pid)
+  if err != nil {
+    return false
+  }
+  process.Release()
+  return true
+}
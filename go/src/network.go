@@ -1,10 +1,39 @@
 package main
 
 import (
+  "bytes"
+  "compress/gzip"
+  "context"
+  "crypto/hmac"
+  "crypto/md5"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/sha512"
+  "crypto/tls"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "hash"
+  "html/template"
   "io"
+  "io/ioutil"
+  "mime"
+  "mime/multipart"
+  "net"
   "net/http"
+  "net/http/httptrace"
+  "net/url"
   "os"
   "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
 )
 
 /*
@@ -28,6 +57,269 @@ func ForwardRequestToURL(request *http.Request, URL string) (*http.Response, err
   return httpClient.Do(proxyRequest)
 }
 
+/*
+ * Options for ForwardRequestWithOptions().
+ */
+type ForwardOptions struct {
+  // Send the target URL's host as the Host header, for upstreams that route by
+  // virtual host. Otherwise the client's Host is passed through, as a reverse
+  // proxy usually does.
+  RewriteHost bool
+  // When rewriting the Host, keep the client's original Host in X-Forwarded-Host.
+  ForwardedHost bool
+  // Gzip the request body on the way upstream (streaming, so it's sent chunked
+  // without a Content-Length). Only set this for upstreams known to accept
+  // "Content-Encoding: gzip" requests; many servers don't. Bodies that are already
+  // encoded, or declare a length under CompressMinBytes, are sent as-is.
+  CompressBody bool
+  // The smallest body worth compressing. Defaults to 1400 bytes (about one packet).
+  CompressMinBytes int64
+  // If non-empty, only responses with one of these media types (e.g. "application/json",
+  // or "image/*" for a whole family) are returned; others are closed and
+  // ErrDisallowedContentType is returned. Parameters such as charset are ignored,
+  // and a response with no Content-Type is disallowed.
+  AllowedContentTypes []string
+  // Fail if connecting to the upstream takes longer than this, so an unreachable
+  // host is given up on quickly. 0 uses http.DefaultTransport's 30 second dial timeout.
+  DialTimeout time.Duration
+  // Fail if the upstream hasn't sent its response headers this long after the
+  // request was written, which bounds how long a live upstream may spend
+  // processing. It doesn't limit reading the body. 0 waits indefinitely.
+  ResponseHeaderTimeout time.Duration
+}
+
+var ErrDisallowedContentType = errors.New("Response has a disallowed content type")
+
+/*
+ * Synchronously forward a request to a different URL.
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @param options how to forward the request
+ * @returns either the server's response or an error
+ *
+ * ForwardRequestToURL() is the same as this with RewriteHost set, since Go's client
+ * sends the URL's host unless told otherwise.
+ *
+ * The forwarded request carries request's context, so the context's deadline
+ * (or the client going away) still bounds the whole exchange, body included.
+ * DialTimeout and ResponseHeaderTimeout are separate, shorter limits on parts of
+ * it; whichever runs out first wins, and neither can extend the context's deadline.
+ */
+func ForwardRequestWithOptions(request *http.Request, URL string, options ForwardOptions) (*http.Response, error) {
+  minBytes := options.CompressMinBytes
+  if minBytes <= 0 {
+    minBytes = 1400
+  }
+  body := request.Body
+  compress := options.CompressBody && body != nil && body != http.NoBody && request.Header.Get("Content-Encoding") == "" && (request.ContentLength < 0 || request.ContentLength >= minBytes)
+  if compress {
+    pipeReader, pipeWriter := io.Pipe()
+    go func() {
+      gzipWriter := gzip.NewWriter(pipeWriter)
+      _, err := io.Copy(gzipWriter, request.Body)
+      if err == nil {
+        err = gzipWriter.Close()
+      }
+      pipeWriter.CloseWithError(err)
+    }()
+    body = pipeReader
+  }
+  proxyRequest, err := http.NewRequestWithContext(request.Context(), request.Method, URL, body)
+  if err != nil {
+    if compress {
+      // Unblocks the compressing goroutine.
+      body.Close()
+    }
+    return nil, err
+  }
+  proxyRequest.Header = make(http.Header)
+  for key, value := range request.Header {
+    proxyRequest.Header[key] = value
+  }
+  if compress {
+    proxyRequest.Header.Del("Content-Length")
+    proxyRequest.Header.Set("Content-Encoding", "gzip")
+  }
+  if !options.RewriteHost {
+    proxyRequest.Host = request.Host
+  } else if options.ForwardedHost && request.Host != "" {
+    proxyRequest.Header.Set("X-Forwarded-Host", request.Host)
+  }
+  httpClient := http.Client{Transport: forwardTransport(options.DialTimeout, options.ResponseHeaderTimeout)}
+  response, err := httpClient.Do(proxyRequest)
+  if err != nil || len(options.AllowedContentTypes) == 0 {
+    return response, err
+  }
+  mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+  for _, allowed := range options.AllowedContentTypes {
+    allowed = strings.ToLower(allowed)
+    if mediaType != "" && (mediaType == allowed || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed) - 1]))) {
+      return response, nil
+    }
+  }
+  response.Body.Close()
+  return nil, fmt.Errorf("%w: %q", ErrDisallowedContentType, response.Header.Get("Content-Type"))
+}
+
+type forwardTimeouts struct {
+  dial time.Duration
+  responseHeader time.Duration
+}
+
+var forwardTransports = map[forwardTimeouts]*http.Transport{}
+var forwardTransportsLock sync.Mutex
+
+// Returns a shared transport for each combination of timeouts, so connections are still pooled.
+func forwardTransport(dialTimeout time.Duration, responseHeaderTimeout time.Duration) http.RoundTripper {
+  if dialTimeout <= 0 && responseHeaderTimeout <= 0 {
+    return http.DefaultTransport
+  }
+  key := forwardTimeouts{dialTimeout, responseHeaderTimeout}
+  forwardTransportsLock.Lock()
+  defer forwardTransportsLock.Unlock()
+  transport, ok := forwardTransports[key]
+  if !ok {
+    transport = http.DefaultTransport.(*http.Transport).Clone()
+    if dialTimeout > 0 {
+      dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+      transport.DialContext = dialer.DialContext
+    }
+    transport.ResponseHeaderTimeout = responseHeaderTimeout
+    forwardTransports[key] = transport
+  }
+  return transport
+}
+
+var ErrHostNotAllowed = errors.New("Host is not allowed")
+
+/*
+ * Synchronously forward a request to a URL, but only if its host is on an allowlist.
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @param allowedHosts the hostnames (without ports) that may be forwarded to, e.g. "api.example.com"
+ * @returns either the server's response, or ErrHostNotAllowed, or another error
+ *
+ * This guards against SSRF when the URL is partly user-controlled. Hosts are
+ * compared case-insensitively, and redirects are only followed to allowed hosts.
+ * Unless a host is allowlisted as a literal IP, connections to loopback, private,
+ * link-local, and unspecified addresses are refused too. That check is made on
+ * the address actually dialed, so an allowed name whose DNS points (or is
+ * rebound) at an internal address is still blocked.
+ */
+func ForwardRequestToAllowedURL(request *http.Request, URL string, allowedHosts []string) (*http.Response, error) {
+  allowed := map[string]bool{}
+  allowedIPs := map[string]bool{}
+  for _, host := range allowedHosts {
+    allowed[strings.ToLower(host)] = true
+    if ip := net.ParseIP(host); ip != nil {
+      allowedIPs[ip.String()] = true
+    }
+  }
+  checkHost := func(u *url.URL) error {
+    if !allowed[strings.ToLower(u.Hostname())] {
+      return fmt.Errorf("%w: %s", ErrHostNotAllowed, u.Hostname())
+    }
+    return nil
+  }
+  proxyRequest, err := http.NewRequest(request.Method, URL, request.Body)
+  if err != nil {
+    return nil, err
+  }
+  err = checkHost(proxyRequest.URL)
+  if err != nil {
+    return nil, err
+  }
+  proxyRequest.Header = make(http.Header)
+  for key, value := range request.Header {
+    proxyRequest.Header[key] = value
+  }
+  dialer := &net.Dialer{
+    Timeout: 30 * time.Second,
+    Control: func(network string, address string, conn syscall.RawConn) error {
+      host, _, err := net.SplitHostPort(address)
+      if err != nil {
+        return err
+      }
+      ip := net.ParseIP(host)
+      if ip == nil || allowedIPs[ip.String()] {
+        return nil
+      }
+      if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+        return fmt.Errorf("%w: %s resolves to internal address %s", ErrHostNotAllowed, proxyRequest.URL.Hostname(), host)
+      }
+      return nil
+    },
+  }
+  // No HTTP_PROXY: a proxy would do the resolving, out of reach of the check above.
+  transport := &http.Transport{
+    DialContext: dialer.DialContext,
+    TLSHandshakeTimeout: 10 * time.Second,
+  }
+  defer transport.CloseIdleConnections()
+  httpClient := http.Client{
+    Transport: transport,
+    CheckRedirect: func(next *http.Request, via []*http.Request) error {
+      if len(via) >= 10 {
+        return errors.New("stopped after 10 redirects")
+      }
+      return checkHost(next.URL)
+    },
+  }
+  return httpClient.Do(proxyRequest)
+}
+
+/*
+ * Timings gathered while forwarding a request with ForwardRequestTimed().
+ * DNS, Connect, and TLSHandshake are zero when a pooled connection was reused.
+ * TimeToFirstByte and Total are measured from when the request was started;
+ * Total ends once the response headers arrive, since the body is read later by the caller.
+ */
+type ForwardMetrics struct {
+  DNS time.Duration
+  Connect time.Duration
+  TLSHandshake time.Duration
+  TimeToFirstByte time.Duration
+  Total time.Duration
+  ReusedConnection bool
+}
+
+/*
+ * Synchronously forward a request to a different URL and time the upstream.
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @returns the server's response, the timings, and an error
+ *
+ * This behaves like ForwardRequestToURL() but also reports where the time went.
+ */
+func ForwardRequestTimed(request *http.Request, URL string) (*http.Response, ForwardMetrics, error) {
+  metrics := ForwardMetrics{}
+  proxyRequest, err := http.NewRequest(request.Method, URL, request.Body)
+  if err != nil {
+    return nil, metrics, err
+  }
+  proxyRequest.Header = make(http.Header)
+  for key, value := range request.Header {
+    proxyRequest.Header[key] = value
+  }
+  var start, dnsStart, connectStart, tlsStart time.Time
+  trace := &httptrace.ClientTrace{
+    DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+    DNSDone: func(httptrace.DNSDoneInfo) { metrics.DNS = time.Since(dnsStart) },
+    ConnectStart: func(string, string) { connectStart = time.Now() },
+    ConnectDone: func(string, string, error) { metrics.Connect = time.Since(connectStart) },
+    TLSHandshakeStart: func() { tlsStart = time.Now() },
+    TLSHandshakeDone: func(tls.ConnectionState, error) { metrics.TLSHandshake = time.Since(tlsStart) },
+    GotConn: func(info httptrace.GotConnInfo) { metrics.ReusedConnection = info.Reused },
+    GotFirstResponseByte: func() { metrics.TimeToFirstByte = time.Since(start) },
+  }
+  proxyRequest = proxyRequest.WithContext(httptrace.WithClientTrace(proxyRequest.Context(), trace))
+  httpClient := http.Client{}
+  start = time.Now()
+  response, err := httpClient.Do(proxyRequest)
+  metrics.Total = time.Since(start)
+  return response, metrics, err
+}
+
 /*
  * Synchronously forward a HTTP response to a writer's client.
  * @param writer the writer whose client will receive the response
@@ -60,7 +352,7 @@ func ForwardRequestToURL(request *http.Request, URL string) (*http.Response, err
  *   }
  *
  */
-func ForwardResponseToClient(writer http.ResponseWriter, response *http.Response)
+func ForwardResponseToClient(writer http.ResponseWriter, response *http.Response) {
   headersToRelay := writer.Header()
   for key, value := range response.Header {
     for _, v := range value {
@@ -73,94 +365,1425 @@ func ForwardResponseToClient(writer http.ResponseWriter, response *http.Response
 }
 
 /*
- * Save the Body of a HTTP request to disk.
- * @param request - the request whose body we are saving
- * @param filePath - the path to save the body to
- * @param overwrite - whether to overwrite if an entity already exists at filePath
+ * Like ForwardResponseToClient(), but flushes the body to the client as it arrives.
+ * @param writer the writer whose client will receive the response
+ * @param response the HTTP response to send via the writer
+ * @param interval how often to flush, or 0 to flush after every chunk read from upstream
+ * @returns an error from copying the body, if any
+ *
+ * Without flushing, a ResponseWriter holds data in its buffer until it fills up,
+ * which stalls server-sent events and slow downloads. With a positive interval,
+ * data is flushed at least that often (by a timer, so it goes out even if the
+ * upstream then goes quiet), batching the flushes of a fast upstream.
+ * If the writer isn't an http.Flusher, this is a plain copy.
+ */
+func ForwardResponseFlushing(writer http.ResponseWriter, response *http.Response, interval time.Duration) error {
+  defer response.Body.Close()
+  headersToRelay := writer.Header()
+  for key, value := range response.Header {
+    for _, v := range value {
+      headersToRelay.Add(key, v)
+    }
+  }
+  writer.WriteHeader(response.StatusCode)
+  flusher, ok := writer.(http.Flusher)
+  if !ok {
+    _, err := io.Copy(writer, response.Body)
+    return err
+  }
+  flushing := &flushingWriter{writer: writer, flusher: flusher, eager: interval <= 0}
+  if interval > 0 {
+    ticker := time.NewTicker(interval)
+    done := make(chan struct{})
+    defer func() {
+      ticker.Stop()
+      close(done)
+    }()
+    go func() {
+      for {
+        select {
+        case <-ticker.C:
+          flushing.flush()
+        case <-done:
+          return
+        }
+      }
+    }()
+  }
+  _, err := io.Copy(flushing, response.Body)
+  flushing.flush()
+  return err
+}
+
+// Writes to a ResponseWriter, flushing after every write if eager, and whenever flush() is called.
+type flushingWriter struct {
+  writer io.Writer
+  flusher http.Flusher
+  eager bool
+  // Guards the ResponseWriter, which may not be used concurrently.
+  mutex sync.Mutex
+  dirty bool
+}
+
+func (flushing *flushingWriter) Write(data []byte) (int, error) {
+  flushing.mutex.Lock()
+  defer flushing.mutex.Unlock()
+  n, err := flushing.writer.Write(data)
+  flushing.dirty = true
+  if flushing.eager {
+    flushing.flusher.Flush()
+    flushing.dirty = false
+  }
+  return n, err
+}
+
+func (flushing *flushingWriter) flush() {
+  flushing.mutex.Lock()
+  defer flushing.mutex.Unlock()
+  if flushing.dirty {
+    flushing.flusher.Flush()
+    flushing.dirty = false
+  }
+}
+
+/*
+ * Like ForwardResponseToClient(), but rewrites the body on its way to the client.
+ * @param writer the writer whose client will receive the response
+ * @param response the HTTP response to send via the writer
+ * @param transform reads the upstream body from r and writes the new body to w
+ * @returns an error from the transform, if any
+ *
+ * The status and headers are relayed, except Content-Length, since the transform
+ * may change the length. The body is passed to the transform exactly as the upstream
+ * sent it, so check Content-Encoding before rewriting text.
+ * The headers have already been sent by the time the transform runs, so an error
+ * can't change the status code. To keep the client from mistaking a truncated body
+ * for a complete one, the caller can panic(http.ErrAbortHandler) on error.
+ */
+func ForwardResponseTransformed(writer http.ResponseWriter, response *http.Response, transform func(w io.Writer, r io.Reader) error) error {
+  defer response.Body.Close()
+  headersToRelay := writer.Header()
+  for key, value := range response.Header {
+    if http.CanonicalHeaderKey(key) == "Content-Length" {
+      continue
+    }
+    for _, v := range value {
+      headersToRelay.Add(key, v)
+    }
+  }
+  writer.WriteHeader(response.StatusCode)
+  return transform(writer, response.Body)
+}
+
+/*
+ * Work out the content type of a response from its body, without losing any of the body.
+ * @param response the response to inspect
+ * @returns the sniffed content type, a replacement for response.Body, and an error
+ *
+ * Up to the first 512 bytes are read and passed to http.DetectContentType().
+ * The returned body replays them before the rest of the stream, and closing it
+ * closes response.Body. On error, the caller still needs to close response.Body.
+ * The body is sniffed exactly as sent, so a compressed body (see Content-Encoding)
+ * is detected as its compression format.
+ */
+func SniffResponseContentType(response *http.Response) (string, io.ReadCloser, error) {
+  head := make([]byte, 512)
+  n, err := io.ReadFull(response.Body, head)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return "", nil, err
+  }
+  head = head[:n]
+  body := replayReadCloser{io.MultiReader(bytes.NewReader(head), response.Body), response.Body}
+  return http.DetectContentType(head), body, nil
+}
+
+type replayReadCloser struct {
+  io.Reader
+  io.Closer
+}
+
+/*
+ * Options for ForwardAndArchiveWithOptions().
+ */
+type ArchiveOptions struct {
+  // If the client goes away before the whole response is sent, stop and discard
+  // the archive. Otherwise the rest of the response is still read into the archive.
+  AbortOnDisconnect bool
+}
+
+/*
+ * Forward a request, sending the response to the client and saving its body to a file at the same time.
+ * @param writer the writer whose client will receive the response
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @param archivePath the file to save the response body to
  * @returns an error
  *
- * This method only reliably works on requests less than 10 MB.
+ * Same as ForwardAndArchiveWithOptions() with the default options.
  */
-func SaveRequestBodyAsFile(request *http.Request, filePath string, overwrite bool) error {
-  if !overwrite {
-    _, err := os.Stat(filePath)
-    if os.IsNotExist(err) {
-      // Continue
-    } else if err != nil {
-      return err
-    } else {
-      return errors.New("File already exists")
+func ForwardAndArchive(writer http.ResponseWriter, request *http.Request, URL string, archivePath string) error {
+  return ForwardAndArchiveWithOptions(writer, request, URL, archivePath, ArchiveOptions{})
+}
+
+/*
+ * Forward a request, sending the response to the client and saving its body to a file at the same time.
+ * @param writer the writer whose client will receive the response
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @param archivePath the file to save the response body to
+ * @param options what to do if the client disconnects
+ * @returns an error
+ *
+ * The response is relayed with ForwardResponseToClient(). The archive is written
+ * atomically, so it only appears once the whole body has been read. If the
+ * upstream can't be reached the client gets a 502, and if it responds with a
+ * non-2xx status that response is relayed as-is; neither is archived. A failure
+ * partway through the body leaves no archive either.
+ */
+func ForwardAndArchiveWithOptions(writer http.ResponseWriter, request *http.Request, URL string, archivePath string, options ArchiveOptions) error {
+  response, err := ForwardRequestToURL(request, URL)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadGateway)
+    return err
+  }
+  if response.StatusCode < 200 || response.StatusCode > 299 {
+    ForwardResponseToClient(writer, response)
+    return fmt.Errorf("%s responded with %s", URL, response.Status)
+  }
+  body := response.Body
+  defer body.Close()
+  return writeFileAtomic(archivePath, 0644, func(file *os.File) error {
+    archiving := &archivingReader{reader: body, file: file}
+    response.Body = archiving
+    ForwardResponseToClient(writer, response)
+    if archiving.readErr == nil && archiving.writeErr == nil {
+      if ctxErr := request.Context().Err(); ctxErr != nil && options.AbortOnDisconnect {
+        return fmt.Errorf("Client disconnected: %w", ctxErr)
+      }
+      // Read whatever the client didn't take.
+      io.Copy(ioutil.Discard, archiving)
     }
+    if archiving.readErr != nil {
+      return archiving.readErr
+    }
+    return archiving.writeErr
+  })
+}
+
+// Copies everything read into a file, remembering (rather than returning) errors
+// from the file, so the client isn't cut off if only the archive fails.
+type archivingReader struct {
+  reader io.Reader
+  file *os.File
+  readErr error
+  writeErr error
+}
+
+func (archiving *archivingReader) Read(buffer []byte) (int, error) {
+  n, err := archiving.reader.Read(buffer)
+  if n > 0 && archiving.writeErr == nil {
+    _, archiving.writeErr = archiving.file.Write(buffer[:n])
+  }
+  if err != nil && err != io.EOF {
+    archiving.readErr = err
+  }
+  return n, err
+}
+
+// The real body is closed once the archive is done with it.
+func (archiving *archivingReader) Close() error {
+  return nil
+}
+
+/*
+ * Send a file to a client, with support for conditional and range requests.
+ * @param writer the writer whose client will receive the file
+ * @param request the client's request
+ * @param filePath the file to send
+ * @returns an error if the file can't be opened (in which case nothing has been sent)
+ *
+ * A weak ETag (see FileETag()) and Last-Modified are set, so clients can
+ * revalidate with If-None-Match or If-Modified-Since and get a 304.
+ */
+func ServeFile(writer http.ResponseWriter, request *http.Request, filePath string) error {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return err
   }
-  data, err := ioutil.ReadAll(request.Body)
+  defer file.Close()
+  info, err := file.Stat()
   if err != nil {
     return err
   }
-  err = ioutil.WriteFile(path, data, os.FileMode(0644))
+  if info.IsDir() {
+    return fmt.Errorf("%s is a directory", filePath)
+  }
+  etag, err := FileETag(filePath, false)
   if err != nil {
     return err
   }
+  writer.Header().Set("ETag", etag)
+  http.ServeContent(writer, request, info.Name(), info.ModTime(), file)
   return nil
 }
 
 /*
- * Saves the contents of a POST request to disk.
- * @param request the request with the POST data
- * @param dirPath the root directory to save the POST data to
+ * Send a file to a client as a download, with support for resuming and for checking its integrity.
+ * @param writer the writer whose client will receive the file
+ * @param request the client's request
+ * @param filePath the file to send
+ * @param downloadName the name the client should save it as, or "" for the file's own name
+ * @returns an error if the file can't be opened or read (in which case nothing has been sent)
+ *
+ * Like ServeFile(), this handles HEAD, conditional, and range requests with
+ * http.ServeContent(), but the ETag is strong (the file's SHA-256), so clients
+ * can resume with If-Range, and the same hash is sent as Repr-Digest (RFC 9530)
+ * for checking the finished download. Responses to requests without a Range also
+ * get a matching Content-Digest. The name is cleaned with SanitizeFilename() and
+ * sent in Content-Disposition both as an ASCII fallback and RFC 5987-encoded.
+ * The whole file is hashed on every request, so this suits files up to a few
+ * hundred MB; beyond that, precompute the hash and set the headers yourself.
  */
-func SaveFormPostAsFiles(request *http.Request, dirPath string, sizeLimit int64) error {
-  // https://freshman.tech/file-upload-golang/
-  err := request.ParseMultipartForm(sizeLimit)
+func ServeDownload(writer http.ResponseWriter, request *http.Request, filePath string, downloadName string) error {
+  file, err := os.Open(filePath)
   if err != nil {
     return err
   }
-  dir, file, err := IsDirFile(dirPath)
+  defer file.Close()
+  info, err := file.Stat()
   if err != nil {
     return err
   }
-  if file {
-    sendError(writer, 400, "Internal Server Error: file exists at path")
-    return
+  if info.IsDir() {
+    return fmt.Errorf("%s is a directory", filePath)
   }
-  if ! dir {
-    err = os.Mkdir(dirPath, os.ModePerm)
-    if err != nil {
-      sendError(writer, 500, "Internal Server Error: %v", err)
-      return
+  // Hash the open file, not the path, so the headers match what's sent even if the file is replaced.
+  hasher := sha256.New()
+  _, err = io.Copy(hasher, file)
+  if err != nil {
+    return err
+  }
+  _, err = file.Seek(0, io.SeekStart)
+  if err != nil {
+    return err
+  }
+  sum := hasher.Sum(nil)
+  if downloadName == "" {
+    downloadName = info.Name()
+  }
+  name, err := SanitizeFilename(downloadName)
+  if err != nil {
+    name = "download"
+  }
+  fallback, err := SanitizeFilenameWithOptions(name, SanitizeOptions{Strict: true})
+  if err != nil {
+    fallback = "download"
+  }
+  header := writer.Header()
+  header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encodeRFC5987(name)))
+  header.Set("ETag", `"` + hex.EncodeToString(sum) + `"`)
+  digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+  header.Set("Repr-Digest", digest)
+  if request.Header.Get("Range") == "" {
+    header.Set("Content-Digest", digest)
+  }
+  http.ServeContent(writer, request, name, info.ModTime(), file)
+  return nil
+}
+
+// Percent-encodes everything but RFC 5987's attr-chars.
+func encodeRFC5987(value string) string {
+  encoded := strings.Builder{}
+  for _, b := range []byte(value) {
+    if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+      encoded.WriteByte(b)
+    } else {
+      fmt.Fprintf(&encoded, "%%%02X", b)
     }
   }
-  for newFileName, fileHeaders := range request.MultipartForm.File {
-    for _, fileHeader := range fileHeaders {
-      file, err := fileHeader.Open()
-      if err != nil {
-        sendError(writer, 500, "Internal Server Error: %v", err)
-        return
+  return encoded.String()
+}
+
+/*
+ * Save the Body of a HTTP request to disk.
+ * @param request - the request whose body we are saving
+ * @param filePath - the path to save the body to
+ * @param overwrite - whether to overwrite if an entity already exists at filePath
+ * @returns an error
+ *
+ * Same as SaveRequestBodyAsFileWithOptions() with only Overwrite set.
+ */
+func SaveRequestBodyAsFile(request *http.Request, filePath string, overwrite bool) error {
+  return SaveRequestBodyAsFileWithOptions(request, filePath, SaveBodyOptions{Overwrite: overwrite})
+}
+
+var ErrShortBody = errors.New("Request body is shorter than its Content-Length")
+
+/*
+ * Options for SaveRequestBodyAsFileWithOptions().
+ */
+type SaveBodyOptions struct {
+  // Whether to overwrite if an entity already exists at the path.
+  Overwrite bool
+  // If the request declares a Content-Length, fail with ErrShortBody unless
+  // exactly that many bytes arrive. This catches dropped connections and hand-built
+  // requests whose bodies don't match their headers.
+  VerifyLength bool
+}
+
+/*
+ * Save the Body of a HTTP request to disk.
+ * @param request the request whose body we are saving
+ * @param filePath the path to save the body to
+ * @param options how to save the body
+ * @returns ErrShortBody (see VerifyLength), or another error
+ *
+ * The body is streamed to a temporary file that is renamed into place once it's
+ * complete, so a failed upload never leaves a partial file at filePath.
+ */
+func SaveRequestBodyAsFileWithOptions(request *http.Request, filePath string, options SaveBodyOptions) error {
+  if !options.Overwrite {
+    _, err := os.Stat(filePath)
+    if os.IsNotExist(err) {
+      // Continue
+    } else if err != nil {
+      return err
+    } else {
+      return errors.New("File already exists")
+    }
+  }
+  return writeFileAtomic(filePath, 0644, func(file *os.File) error {
+    n, err := io.Copy(file, request.Body)
+    if options.VerifyLength && request.ContentLength >= 0 {
+      if err == io.ErrUnexpectedEOF || (err == nil && n < request.ContentLength) {
+        return fmt.Errorf("%w: got %d of %d bytes", ErrShortBody, n, request.ContentLength)
       }
-      defer file.Close()
-      _, err = file.Seek(0, io.SeekStart)
-      if err != nil {
-        sendError(writer, 500, "Internal Server Error: %v", err)
-        return
+      if err == nil && n > request.ContentLength {
+        return fmt.Errorf("Request body is longer than its Content-Length of %d", request.ContentLength)
       }
-      err = os.MkdirAll(filepath.Dir(dirPath + "/" + fileHeader.Filename), 0755)
+    }
+    return wrapDiskFull(filePath, err)
+  })
+}
+
+/*
+ * Hand each file in a multipart/form-data request to a function as it arrives, without saving it.
+ * @param request the request whose files to read
+ * @param fn called with each file part's form field, its file name (as sent by the client), and its contents
+ * @returns the first error from reading the request or from fn
+ *
+ * Parts are read straight from the request body, so memory use doesn't depend on
+ * the file sizes and fn can pipe files on elsewhere. Each reader is only valid
+ * until fn returns, and whatever fn doesn't read is skipped. Non-file fields
+ * are skipped too. The file name is untrusted; clean it with SanitizeFilename()
+ * before using it in a path.
+ */
+func StreamMultipartFiles(request *http.Request, fn func(fieldName, fileName string, r io.Reader) error) error {
+  reader, err := request.MultipartReader()
+  if err != nil {
+    return err
+  }
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+    if part.FileName() != "" {
+      err = fn(part.FormName(), part.FileName(), part)
+    }
+    part.Close()
+    if err != nil {
+      return err
+    }
+  }
+}
+
+var ErrNoChecksum = errors.New("Request has no checksum")
+var ErrChecksumMismatch = errors.New("Request body does not match its checksum")
+
+/*
+ * Save the Body of a HTTP request to disk, checking it against a checksum sent by the client.
+ * @param request the request whose body we are saving
+ * @param filePath the path to save the body to
+ * @param algo one of "md5", "sha1", "sha256", or "sha512"
+ * @returns ErrNoChecksum, ErrChecksumMismatch, or another error
+ *
+ * The checksum is read from the "X-Content-<ALGO>" (e.g. "X-Content-SHA256")
+ * trailer, which lets clients compute it while streaming, or else from the
+ * header of the same name. Hex and base64 are both accepted.
+ * The body is streamed to disk while being hashed, and only moved to filePath
+ * if it matches, so nothing is left behind on failure.
+ */
+func SaveRequestBodyVerifyingTrailer(request *http.Request, filePath string, algo string) error {
+  newHashers := map[string]func() hash.Hash{"md5": md5.New, "sha1": sha1.New, "sha256": sha256.New, "sha512": sha512.New}
+  newHasher, ok := newHashers[strings.ToLower(algo)]
+  if !ok {
+    return fmt.Errorf("unsupported checksum algorithm: %s", algo)
+  }
+  hasher := newHasher()
+  headerName := "X-Content-" + strings.ToUpper(algo)
+  // Fail before reading the body if there's no way a checksum will show up.
+  _, inTrailer := request.Trailer[http.CanonicalHeaderKey(headerName)]
+  if !inTrailer && request.Header.Get(headerName) == "" {
+    return ErrNoChecksum
+  }
+  return writeFileAtomic(filePath, 0644, func(file *os.File) error {
+    _, err := io.Copy(file, io.TeeReader(request.Body, hasher))
+    if err != nil {
+      return wrapDiskFull(filePath, err)
+    }
+    // Trailers are only filled in once the body has been read to the end.
+    expected := request.Trailer.Get(headerName)
+    if expected == "" {
+      expected = request.Header.Get(headerName)
+    }
+    if expected == "" {
+      return ErrNoChecksum
+    }
+    sum := hasher.Sum(nil)
+    if strings.EqualFold(expected, hex.EncodeToString(sum)) || expected == base64.StdEncoding.EncodeToString(sum) {
+      return nil
+    }
+    return ErrChecksumMismatch
+  })
+}
+
+/*
+ * Saves the contents of a POST request to disk.
+ * @param request the request with the POST data
+ * @param dirPath the root directory to save the POST data to
+ * @param sizeLimit the maximum number of bytes of the form to hold in memory (see http.Request.ParseMultipartForm())
+ * @returns an error (ErrInvalidFilename if a field name can't be used as a filename)
+ *
+ * Each file is saved under its form field's name, cleaned with SanitizeFilename(),
+ * so a client can't write outside dirPath. The client's own filename is ignored.
+ */
+func SaveFormPostAsFiles(request *http.Request, dirPath string, sizeLimit int64) error {
+  // https://freshman.tech/file-upload-golang/
+  err := request.ParseMultipartForm(sizeLimit)
+  if err != nil {
+    return err
+  }
+  dir, file, err := IsDirFile(dirPath)
+  if err != nil {
+    return err
+  }
+  if file {
+    return fmt.Errorf("%s is a file, not a directory", dirPath)
+  }
+  if ! dir {
+    err = os.Mkdir(dirPath, os.ModePerm)
+    if err != nil {
+      return err
+    }
+  }
+  for fieldName, fileHeaders := range request.MultipartForm.File {
+    newFileName, err := SanitizeFilename(fieldName)
+    if err != nil {
+      return fmt.Errorf("%w: field %q", err, fieldName)
+    }
+    for _, fileHeader := range fileHeaders {
+      err = saveFormFile(fileHeader, filepath.Join(dirPath, newFileName))
       if err != nil {
-        sendError(writer, 500, "Internal Server Error: %v", err)
-        return
+        return err
       }
-      // Note, the old file name can be found with `fileHeader.Filename`.
-      f, err := os.Create(filepath.Join(dirPath, newFileName))
+    }
+  }
+  return nil
+}
+
+// Copies an uploaded file to filePath.
+func saveFormFile(fileHeader *multipart.FileHeader, filePath string) error {
+  file, err := fileHeader.Open()
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  f, err := os.Create(filePath)
+  if err != nil {
+    return err
+  }
+  _, err = io.Copy(f, file)
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+  return wrapDiskFull(filePath, err)
+}
+
+var ErrInvalidToken = errors.New("Invalid upload token")
+var ErrTokenExpired = errors.New("Upload token expired")
+
+/*
+ * Issues opaque, expiring tokens that each grant an upload to one path under a base directory,
+ * so clients never get to choose where on disk their upload goes.
+ *
+ * A token is the relative path and expiry time, signed with HMAC-SHA256. Anyone
+ * holding the secret can issue tokens, so keep it private.
+ */
+type UploadTokenizer struct {
+  secret []byte
+  baseDir string
+}
+
+func NewUploadTokenizer(secret []byte, baseDir string) *UploadTokenizer {
+  return &UploadTokenizer{secret: secret, baseDir: baseDir}
+}
+
+/*
+ * @param relPath the destination, relative to the tokenizer's base directory
+ * @param ttl how long the token is valid for
+ * @returns the token
+ */
+func (tokenizer *UploadTokenizer) IssueToken(relPath string, ttl time.Duration) string {
+  payload := base64.RawURLEncoding.EncodeToString([]byte(filepath.ToSlash(relPath))) + "." + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+  return payload + "." + tokenizer.sign(payload)
+}
+
+/*
+ * @param token a token from IssueToken()
+ * @returns the destination path (under the base directory), or ErrInvalidToken, or ErrTokenExpired
+ */
+func (tokenizer *UploadTokenizer) ResolveToken(token string) (string, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return "", ErrInvalidToken
+  }
+  payload := parts[0] + "." + parts[1]
+  if !hmac.Equal([]byte(parts[2]), []byte(tokenizer.sign(payload))) {
+    return "", ErrInvalidToken
+  }
+  expiry, err := strconv.ParseInt(parts[1], 10, 64)
+  if err != nil {
+    return "", ErrInvalidToken
+  }
+  if time.Now().Unix() > expiry {
+    return "", ErrTokenExpired
+  }
+  relPath, err := base64.RawURLEncoding.DecodeString(parts[0])
+  if err != nil {
+    return "", ErrInvalidToken
+  }
+  // Even a validly-signed token must not point outside the base directory.
+  destPath := filepath.Join(tokenizer.baseDir, filepath.FromSlash(string(relPath)))
+  inside, err := filepath.Rel(filepath.Clean(tokenizer.baseDir), destPath)
+  if err != nil || inside == "." || inside == ".." || strings.HasPrefix(inside, ".." + string(os.PathSeparator)) || filepath.IsAbs(inside) {
+    return "", ErrInvalidToken
+  }
+  return destPath, nil
+}
+
+func (tokenizer *UploadTokenizer) sign(payload string) string {
+  mac := hmac.New(sha256.New, tokenizer.secret)
+  mac.Write([]byte(payload))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Saves the contents of a POST request to the directory an upload token grants.
+ * @param request the request with the POST data
+ * @param tokenizer the tokenizer that issued the token
+ * @param token the client's upload token
+ * @param sizeLimit the maximum number of bytes of the form to hold in memory (see http.Request.ParseMultipartForm())
+ * @returns an error (see UploadTokenizer.ResolveToken() and SaveFormPostAsFiles())
+ */
+func SaveFormPostWithToken(request *http.Request, tokenizer *UploadTokenizer, token string, sizeLimit int64) error {
+  dirPath, err := tokenizer.ResolveToken(token)
+  if err != nil {
+    return err
+  }
+  return SaveFormPostAsFiles(request, dirPath, sizeLimit)
+}
+
+/*
+ * Describes what a multipart form upload must look like, for ValidateMultipart().
+ */
+type UploadSchema struct {
+  // Text fields that must be present and non-empty.
+  RequiredFields []string
+  // The file fields that may be present. Any other file field is a violation.
+  AllowedFileFields []string
+  // The maximum size, in bytes, of each file in a field. Fields not listed are unlimited.
+  MaxFileSize map[string]int64
+  // If non-empty, every file's sniffed content type (see http.DetectContentType()) must be one of these.
+  AllowedContentTypes []string
+  // The maximum number of bytes of the form to hold in memory (see http.Request.ParseMultipartForm()).
+  MemoryLimit int64
+}
+
+/*
+ * Parse a multipart form and check it against a schema.
+ * @param request the request with the form
+ * @param schema what the form must look like
+ * @returns a description of the first violation, or nil
+ *
+ * Content types are sniffed from each file's first 512 bytes rather than trusted
+ * from the client, and compared ignoring parameters like "charset".
+ */
+func ValidateMultipart(request *http.Request, schema UploadSchema) error {
+  memoryLimit := schema.MemoryLimit
+  if memoryLimit <= 0 {
+    memoryLimit = 32 << 20
+  }
+  err := request.ParseMultipartForm(memoryLimit)
+  if err != nil {
+    return err
+  }
+  form := request.MultipartForm
+  for _, field := range schema.RequiredFields {
+    if len(form.Value[field]) == 0 || form.Value[field][0] == "" {
+      return fmt.Errorf("missing required field %q", field)
+    }
+  }
+  for field, fileHeaders := range form.File {
+    allowed := false
+    for _, allowedField := range schema.AllowedFileFields {
+      allowed = allowed || allowedField == field
+    }
+    if !allowed {
+      return fmt.Errorf("unexpected file field %q", field)
+    }
+    for _, fileHeader := range fileHeaders {
+      if maxSize, ok := schema.MaxFileSize[field]; ok && fileHeader.Size > maxSize {
+        return fmt.Errorf("file %q in field %q is %d bytes, more than the limit of %d", fileHeader.Filename, field, fileHeader.Size, maxSize)
+      }
+      if len(schema.AllowedContentTypes) == 0 {
+        continue
+      }
+      file, err := fileHeader.Open()
       if err != nil {
-        sendError(writer, 500, "Internal Server Error: %v", err)
-        return
+        return err
+      }
+      buffer := make([]byte, 512)
+      n, err := io.ReadFull(file, buffer)
+      file.Close()
+      if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return err
+      }
+      contentType := strings.TrimSpace(strings.Split(http.DetectContentType(buffer[:n]), ";")[0])
+      typeAllowed := false
+      for _, allowedType := range schema.AllowedContentTypes {
+        typeAllowed = typeAllowed || strings.EqualFold(allowedType, contentType)
+      }
+      if !typeAllowed {
+        return fmt.Errorf("file %q in field %q has disallowed content type %s", fileHeader.Filename, field, contentType)
+      }
+    }
+  }
+  return nil
+}
+
+/*
+ * Validates a POST request against a schema, then saves its files to disk.
+ * @param request the request with the POST data
+ * @param dirPath the root directory to save the POST data to
+ * @param schema what the form must look like (see ValidateMultipart())
+ * @returns an error
+ */
+func SaveFormPostAsFilesWithSchema(request *http.Request, dirPath string, schema UploadSchema) error {
+  err := ValidateMultipart(request, schema)
+  if err != nil {
+    return err
+  }
+  return SaveFormPostAsFiles(request, dirPath, schema.MemoryLimit)
+}
+
+/*
+ * Upload a file to a URL that accepts resumable, chunked PUT requests.
+ * @param URL the upload session's URL
+ * @param filePath the file to upload
+ * @param chunkSize how many bytes to send per request
+ * @param sessionHeader an optional "Name: value" header sent with every request (e.g. a session token), or ""
+ * @returns an error
+ *
+ * Each chunk is labeled with "Content-Range: bytes start-end/total". The server
+ * replies 308 ("resume incomplete") with a "Range: bytes=0-N" header while more
+ * data is expected, and 200 or 201 once the upload is complete.
+ * Before sending anything, the server is asked for its committed offset with an
+ * empty PUT, so an interrupted upload picks up where it left off.
+ * An empty file is uploaded with just that empty PUT, which must then get a 2xx response.
+ */
+func UploadFileChunked(URL string, filePath string, chunkSize int64, sessionHeader string) error {
+  if chunkSize <= 0 {
+    return errors.New("chunkSize must be positive")
+  }
+  file, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  total := info.Size()
+  httpClient := http.Client{}
+  send := func(body io.Reader, length int64, contentRange string) (*http.Response, error) {
+    request, err := http.NewRequest("PUT", URL, body)
+    if err != nil {
+      return nil, err
+    }
+    request.ContentLength = length
+    request.Header.Set("Content-Range", contentRange)
+    if sessionHeader != "" {
+      parts := strings.SplitN(sessionHeader, ":", 2)
+      if len(parts) != 2 {
+        return nil, fmt.Errorf("invalid session header: %s", sessionHeader)
       }
-      defer f.Close()
-      _, err = io.Copy(f, file)
+      request.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+    }
+    response, err := httpClient.Do(request)
+    if err != nil {
+      return nil, err
+    }
+    io.Copy(ioutil.Discard, response.Body)
+    response.Body.Close()
+    return response, nil
+  }
+  // Returns the offset the server has committed, or -1 if the upload is complete.
+  committed := func(response *http.Response) (int64, error) {
+    switch response.StatusCode {
+    case http.StatusOK, http.StatusCreated:
+      return -1, nil
+    case http.StatusPermanentRedirect:
+      return parseCommittedRange(response.Header.Get("Range"))
+    }
+    return 0, fmt.Errorf("upload failed: %s", response.Status)
+  }
+
+  if total == 0 {
+    // There's nothing to resume, so the query is also the request that finishes the upload.
+    response, err := send(nil, 0, "bytes */0")
+    if err != nil {
+      return err
+    }
+    if response.StatusCode < 200 || response.StatusCode > 299 {
+      return fmt.Errorf("upload failed: %s", response.Status)
+    }
+    return nil
+  }
+  response, err := send(nil, 0, fmt.Sprintf("bytes */%d", total))
+  if err != nil {
+    return err
+  }
+  offset, err := committed(response)
+  if err != nil {
+    return err
+  }
+  for offset >= 0 {
+    if offset >= total {
+      return fmt.Errorf("server committed %d bytes but did not finish a %d byte upload", offset, total)
+    }
+    length := chunkSize
+    if offset + length > total {
+      length = total - offset
+    }
+    contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset + length - 1, total)
+    response, err = send(io.NewSectionReader(file, offset, length), length, contentRange)
+    if err != nil {
+      return err
+    }
+    offset, err = committed(response)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Parses a "bytes=0-N" Range header into the number of committed bytes (N+1).
+func parseCommittedRange(header string) (int64, error) {
+  if header == "" {
+    return 0, nil
+  }
+  dash := strings.LastIndex(header, "-")
+  if !strings.HasPrefix(header, "bytes=") || dash < 0 {
+    return 0, fmt.Errorf("invalid Range header: %s", header)
+  }
+  end, err := strconv.ParseInt(header[dash + 1:], 10, 64)
+  if err != nil {
+    return 0, fmt.Errorf("invalid Range header: %s", header)
+  }
+  return end + 1, nil
+}
+
+/*
+ * Stream the body of one URL into a request to another, without buffering it.
+ * @param sourceURL the URL to GET
+ * @param destURL the URL to send the body to
+ * @param method the method to use for the destination request (e.g. "PUT" or "POST")
+ * @returns an error if either side fails or the destination responds with a non-2xx status
+ *
+ * The source's Content-Type and Content-Length (when known) are passed along.
+ * If either side fails mid-stream, the pipe between them is closed so the other side stops too.
+ */
+func Relay(sourceURL string, destURL string, method string) error {
+  httpClient := http.Client{}
+  source, err := httpClient.Get(sourceURL)
+  if err != nil {
+    return err
+  }
+  defer source.Body.Close()
+  if source.StatusCode < 200 || source.StatusCode > 299 {
+    return fmt.Errorf("source responded with %s", source.Status)
+  }
+  reader, writer := io.Pipe()
+  go func() {
+    _, err := io.Copy(writer, source.Body)
+    writer.CloseWithError(err)
+  }()
+  destRequest, err := http.NewRequest(method, destURL, reader)
+  if err != nil {
+    reader.CloseWithError(err)
+    return err
+  }
+  destRequest.ContentLength = source.ContentLength
+  if contentType := source.Header.Get("Content-Type"); contentType != "" {
+    destRequest.Header.Set("Content-Type", contentType)
+  }
+  dest, err := httpClient.Do(destRequest)
+  if err != nil {
+    reader.CloseWithError(err)
+    return err
+  }
+  defer dest.Body.Close()
+  // The destination may respond before it has read the whole body.
+  reader.CloseWithError(errors.New("destination responded"))
+  if dest.StatusCode < 200 || dest.StatusCode > 299 {
+    return fmt.Errorf("destination responded with %s", dest.Status)
+  }
+  return nil
+}
+
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+/*
+ * Tracks the health of an upstream for ForwardRequestWithBreaker().
+ *
+ * The breaker starts closed. After `threshold` consecutive failures (network errors
+ * or 5xx responses) it opens, and requests fail immediately with ErrCircuitOpen.
+ * Once `cooldown` has passed it half-opens: a single probe request is let through,
+ * closing the breaker if it succeeds and re-opening it if it fails.
+ * A CircuitBreaker is safe to share between goroutines.
+ */
+type CircuitBreaker struct {
+  threshold int
+  cooldown time.Duration
+  lock sync.Mutex
+  failures int
+  openedAt time.Time
+  probing bool
+  // Bumped whenever the breaker opens or closes, so results of requests sent
+  // in an earlier state can be told apart and ignored.
+  generation uint64
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+  return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Identifies a request let through by allow(), for passing back to record().
+type breakerTicket struct {
+  generation uint64
+  probe bool
+}
+
+// Reports whether a request may be sent now.
+func (breaker *CircuitBreaker) allow() (breakerTicket, bool) {
+  breaker.lock.Lock()
+  defer breaker.lock.Unlock()
+  if breaker.failures < breaker.threshold {
+    return breakerTicket{generation: breaker.generation}, true
+  }
+  if breaker.probing || time.Since(breaker.openedAt) < breaker.cooldown {
+    return breakerTicket{}, false
+  }
+  breaker.probing = true
+  return breakerTicket{generation: breaker.generation, probe: true}, true
+}
+
+// Only the probe's result moves a half-open breaker; results of requests sent
+// before the breaker last opened or closed are ignored.
+func (breaker *CircuitBreaker) record(ticket breakerTicket, success bool) {
+  breaker.lock.Lock()
+  defer breaker.lock.Unlock()
+  if ticket.probe {
+    breaker.probing = false
+    breaker.generation++
+    if success {
+      breaker.failures = 0
+    } else {
+      breaker.openedAt = time.Now()
+    }
+    return
+  }
+  if ticket.generation != breaker.generation || breaker.failures >= breaker.threshold {
+    return
+  }
+  if success {
+    breaker.failures = 0
+    return
+  }
+  breaker.failures++
+  if breaker.failures >= breaker.threshold {
+    breaker.openedAt = time.Now()
+    breaker.generation++
+  }
+}
+
+/*
+ * Forward a request to a different URL, unless the upstream has been failing.
+ * @param breaker the breaker tracking this upstream
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @returns either the server's response or an error (ErrCircuitOpen if the request wasn't sent)
+ *
+ * 5xx responses count as failures, but are still returned to the caller.
+ */
+func ForwardRequestWithBreaker(breaker *CircuitBreaker, request *http.Request, URL string) (*http.Response, error) {
+  ticket, ok := breaker.allow()
+  if !ok {
+    return nil, ErrCircuitOpen
+  }
+  response, err := ForwardRequestToURL(request, URL)
+  breaker.record(ticket, err == nil && response.StatusCode < 500)
+  return response, err
+}
+
+/*
+ * An on-disk cache of upstream responses for ForwardCached().
+ */
+type DiskCache struct {
+  dir string
+  ttl time.Duration
+}
+
+/*
+ * @param dir the directory to store responses in; it is created if needed
+ * @param ttl how long a stored response stays fresh
+ */
+func NewDiskCache(dir string, ttl time.Duration) *DiskCache {
+  return &DiskCache{dir: dir, ttl: ttl}
+}
+
+type diskCacheEntry struct {
+  StatusCode int
+  Status string
+  Header http.Header
+  Stored time.Time
+}
+
+/*
+ * Forward a request to a different URL, answering from the cache when possible.
+ * @param cache where to look up and store responses
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @returns either the (possibly cached) response or an error
+ *
+ * Only GET requests are cached, keyed by a hash of the method and URL, and only
+ * 200 responses are stored. Neither is cached if the request or the response
+ * says "Cache-Control: no-store" (or the response says "private").
+ * The body of a response being stored is written to disk in full before this
+ * returns, and the returned body is then read back from the cache file.
+ */
+func ForwardCached(cache *DiskCache, request *http.Request, URL string) (*http.Response, error) {
+  if request.Method != "GET" || hasCacheDirective(request.Header, "no-store") {
+    return ForwardRequestToURL(request, URL)
+  }
+  sum := sha256.Sum256([]byte(request.Method + " " + URL))
+  key := filepath.Join(cache.dir, hex.EncodeToString(sum[:]))
+  response, err := cache.load(key, request)
+  if err == nil {
+    return response, nil
+  }
+  response, err = ForwardRequestToURL(request, URL)
+  if err != nil {
+    return nil, err
+  }
+  if response.StatusCode != http.StatusOK || hasCacheDirective(response.Header, "no-store") || hasCacheDirective(response.Header, "private") {
+    return response, nil
+  }
+  defer response.Body.Close()
+  err = cache.store(key, response)
+  if err != nil {
+    return nil, err
+  }
+  return cache.load(key, request)
+}
+
+func hasCacheDirective(header http.Header, directive string) bool {
+  for _, value := range header.Values("Cache-Control") {
+    for _, part := range strings.Split(value, ",") {
+      if strings.EqualFold(strings.TrimSpace(part), directive) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// Returns a fresh cached response, or an error if there isn't one.
+func (cache *DiskCache) load(key string, request *http.Request) (*http.Response, error) {
+  data, err := ioutil.ReadFile(key + ".json")
+  if err != nil {
+    return nil, err
+  }
+  entry := diskCacheEntry{}
+  err = json.Unmarshal(data, &entry)
+  if err != nil {
+    return nil, err
+  }
+  if time.Since(entry.Stored) > cache.ttl {
+    return nil, errors.New("Cached response is stale")
+  }
+  body, err := os.Open(key + ".body")
+  if err != nil {
+    return nil, err
+  }
+  info, err := body.Stat()
+  if err != nil {
+    body.Close()
+    return nil, err
+  }
+  return &http.Response{
+    Status: entry.Status,
+    StatusCode: entry.StatusCode,
+    Proto: "HTTP/1.1",
+    ProtoMajor: 1,
+    ProtoMinor: 1,
+    Header: entry.Header,
+    Body: body,
+    ContentLength: info.Size(),
+    Request: request,
+  }, nil
+}
+
+func (cache *DiskCache) store(key string, response *http.Response) error {
+  err := os.MkdirAll(cache.dir, 0755)
+  if err != nil {
+    return err
+  }
+  // The body is written first, so that a metadata file always has a complete body.
+  err = writeFileAtomic(key + ".body", 0644, func(file *os.File) error {
+    _, err := io.Copy(file, response.Body)
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  data, err := json.Marshal(diskCacheEntry{response.StatusCode, response.Status, response.Header, time.Now()})
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(key + ".json", 0644, func(file *os.File) error {
+    _, err := file.Write(data)
+    return err
+  })
+}
+
+/*
+ * Byte counts for a request forwarded by ForwardRequestCounted().
+ * The counts grow as the bodies are read, so read them once you're done with the response.
+ */
+type ForwardCounter struct {
+  requestBytes int64
+  responseBytes int64
+}
+
+// The number of request body bytes sent upstream.
+func (counter *ForwardCounter) RequestBytes() int64 {
+  return atomic.LoadInt64(&counter.requestBytes)
+}
+
+// The number of response body bytes the caller has read so far.
+func (counter *ForwardCounter) ResponseBytes() int64 {
+  return atomic.LoadInt64(&counter.responseBytes)
+}
+
+type countingReadCloser struct {
+  io.ReadCloser
+  count *int64
+}
+
+func (reader countingReadCloser) Read(buffer []byte) (int, error) {
+  n, err := reader.ReadCloser.Read(buffer)
+  atomic.AddInt64(reader.count, int64(n))
+  return n, err
+}
+
+/*
+ * Synchronously forward a request to a different URL, counting the bytes in each direction.
+ * @param request the request to forward
+ * @param URL the URL to forward the request to
+ * @returns the server's response, a counter for the request and response bodies, and an error
+ *
+ * The response body is wrapped so the counter keeps up as the caller reads it
+ * (e.g. via ForwardResponseToClient()). This is handy for metering and quotas.
+ */
+func ForwardRequestCounted(request *http.Request, URL string) (*http.Response, *ForwardCounter, error) {
+  counter := &ForwardCounter{}
+  counted := *request
+  if request.Body != nil {
+    counted.Body = countingReadCloser{request.Body, &counter.requestBytes}
+  }
+  response, err := ForwardRequestToURL(&counted, URL)
+  if err != nil {
+    return nil, counter, err
+  }
+  response.Body = countingReadCloser{response.Body, &counter.responseBytes}
+  return response, counter, nil
+}
+
+/*
+ * Forward many requests to one server at once, keeping the results in order.
+ * @param requests the requests to forward; each is sent to baseURL plus its path and query
+ * @param baseURL the server to forward to, e.g. "https://api.example.com/v1"
+ * @param concurrency how many requests to have in flight at a time
+ * @returns the responses and errors, where index i is for requests[i] and exactly one of the two is nil
+ *
+ * Each request is sent with ForwardRequestToURL(). Bodies are read into memory
+ * first, so that idempotent requests (GET, HEAD, OPTIONS, PUT, DELETE) can be
+ * retried once if they fail without a response (e.g. a reset connection). HTTP
+ * error statuses are responses, not errors, and are never retried.
+ * The caller must close every returned response's body.
+ */
+func ForwardBatch(requests []*http.Request, baseURL string, concurrency int) ([]*http.Response, []error) {
+  if concurrency < 1 {
+    concurrency = 1
+  }
+  responses := make([]*http.Response, len(requests))
+  errs := make([]error, len(requests))
+  baseURL = strings.TrimSuffix(baseURL, "/")
+  jobs := make(chan int)
+  group := sync.WaitGroup{}
+  for i := 0; i < concurrency; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      for index := range jobs {
+        responses[index], errs[index] = forwardWithRetry(requests[index], baseURL + requests[index].URL.RequestURI())
+      }
+    }()
+  }
+  for index := range requests {
+    jobs <- index
+  }
+  close(jobs)
+  group.Wait()
+  return responses, errs
+}
+
+// Forwards a request with ForwardRequestToURL(), retrying once (with the buffered body) if it's idempotent.
+func forwardWithRetry(request *http.Request, URL string) (*http.Response, error) {
+  var body []byte
+  if request.Body != nil {
+    var err error
+    body, err = ioutil.ReadAll(request.Body)
+    request.Body.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  attempts := 1
+  switch request.Method {
+  case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+    attempts = 2
+  }
+  var err error
+  for attempt := 0; attempt < attempts; attempt++ {
+    attemptRequest := request.Clone(request.Context())
+    attemptRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+    var response *http.Response
+    response, err = ForwardRequestToURL(attemptRequest, URL)
+    if err == nil {
+      return response, nil
+    }
+  }
+  return nil, err
+}
+
+/*
+ * Download a URL to a file.
+ * @param URL the URL to GET
+ * @param filePath where to save the response body
+ * @returns an error, including for non-2xx responses
+ *
+ * The file is written atomically, so a failed download leaves nothing behind.
+ * If the server sends a Content-Length, the space is reserved with AllocateFile()
+ * first, so a full disk is reported before anything is downloaded.
+ */
+func DownloadFile(URL string, filePath string) error {
+  return downloadFile(context.Background(), URL, filePath)
+}
+
+func downloadFile(ctx context.Context, URL string, filePath string) error {
+  request, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+  if err != nil {
+    return err
+  }
+  httpClient := http.Client{}
+  response, err := httpClient.Do(request)
+  if err != nil {
+    return err
+  }
+  defer response.Body.Close()
+  if response.StatusCode < 200 || response.StatusCode > 299 {
+    return fmt.Errorf("%s responded with %s", URL, response.Status)
+  }
+  release, err := acquireIO(ctx)
+  defer release()
+  if err != nil {
+    return err
+  }
+  return writeFileAtomic(filePath, 0644, func(file *os.File) error {
+    // Reserve the space first so a full disk fails now, not gigabytes in.
+    if response.ContentLength > 0 {
+      err := allocateFile(file, response.ContentLength)
       if err != nil {
-        sendError(writer, 500, "Internal Server Error: %v", err)
-        return
+        return wrapDiskFull(filePath, err)
       }
     }
+    _, err := io.Copy(file, response.Body)
+    return wrapDiskFull(filePath, err)
+  })
+}
+
+/*
+ * Download many URLs at once.
+ * @param urls maps each URL to the file to save it to
+ * @param workers how many downloads to run at a time
+ * @returns each URL's error (nil if it succeeded)
+ *
+ * Equivalent to DownloadAllContext(context.Background(), urls, workers, 0).
+ */
+func DownloadAll(urls map[string]string, workers int) map[string]error {
+  return DownloadAllContext(context.Background(), urls, workers, 0)
+}
+
+/*
+ * Download many URLs at once.
+ * @param ctx cancels all remaining downloads when done
+ * @param urls maps each URL to the file to save it to
+ * @param workers how many downloads to run at a time
+ * @param timeout the time limit for each download, or 0 for none
+ * @returns each URL's error (nil if it succeeded)
+ *
+ * One download failing doesn't stop the others. Each is done with DownloadFile(),
+ * so failed downloads leave no partial files.
+ */
+func DownloadAllContext(ctx context.Context, urls map[string]string, workers int, timeout time.Duration) map[string]error {
+  if workers < 1 {
+    workers = 1
+  }
+  results := map[string]error{}
+  resultsLock := sync.Mutex{}
+  jobs := make(chan string)
+  group := sync.WaitGroup{}
+  for i := 0; i < workers; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      for URL := range jobs {
+        downloadCtx := ctx
+        cancel := func() {}
+        if timeout > 0 {
+          downloadCtx, cancel = context.WithTimeout(ctx, timeout)
+        }
+        err := ctx.Err()
+        if err == nil {
+          err = downloadFile(downloadCtx, URL, urls[URL])
+        }
+        cancel()
+        resultsLock.Lock()
+        results[URL] = err
+        resultsLock.Unlock()
+      }
+    }()
+  }
+  for URL := range urls {
+    jobs <- URL
+  }
+  close(jobs)
+  group.Wait()
+  return results
+}
+
+var dirListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Title}}</title></head>
+<body>
+<h1>Index of {{.Title}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+/*
+ * Send an HTML page listing a directory's contents.
+ * @param writer the writer whose client will receive the page
+ * @param request the client's request
+ * @param dirPath the directory to list
+ * @param urlPrefix the URL path dirPath is served at (e.g. "/files/photos/")
+ * @returns an error if the directory can't be read (in which case nothing has been sent)
+ *
+ * Directories are listed first, then files, each sorted by name. Names are
+ * escaped both in the links and in the page. A request whose path doesn't end
+ * in "/" is redirected to one that does, so that relative links work.
+ */
+func ServeDirListing(writer http.ResponseWriter, request *http.Request, dirPath string, urlPrefix string) error {
+  if !strings.HasSuffix(request.URL.Path, "/") {
+    target := request.URL.Path + "/"
+    if request.URL.RawQuery != "" {
+      target += "?" + request.URL.RawQuery
+    }
+    http.Redirect(writer, request, target, http.StatusMovedPermanently)
+    return nil
+  }
+  names, err := ChildrenOfDir(dirPath)
+  if err != nil {
+    return err
+  }
+  type entry struct {
+    Name string
+    Href string
+    Size string
+    ModTime string
+    isDir bool
   }
-  sendError(writer, 200, "")
-  return
+  entries := []entry{}
+  for _, name := range names {
+    info, err := os.Stat(filepath.Join(dirPath, name))
+    if err != nil {
+      // E.g. a broken symlink.
+      continue
+    }
+    href := strings.TrimSuffix(urlPrefix, "/") + "/" + url.PathEscape(name)
+    e := entry{Name: name, Href: href, ModTime: info.ModTime().Format("2006-01-02 15:04"), isDir: info.IsDir()}
+    if info.IsDir() {
+      e.Name += "/"
+      e.Href += "/"
+      e.Size = "-"
+    } else {
+      e.Size = formatBytes(float64(info.Size()))
+    }
+    entries = append(entries, e)
+  }
+  sort.Slice(entries, func(i, j int) bool {
+    if entries[i].isDir != entries[j].isDir {
+      return entries[i].isDir
+    }
+    return entries[i].Name < entries[j].Name
+  })
+  writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+  return dirListingTemplate.Execute(writer, struct {
+    Title string
+    Parent bool
+    Entries []entry
+  }{urlPrefix, urlPrefix != "/" && urlPrefix != "", entries})
 }
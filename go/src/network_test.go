@@ -0,0 +1,299 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// Starts an upstream that records the Host header of each request it gets.
+func newHostRecorder(t *testing.T) (*httptest.Server, *string) {
+  host := new(string)
+  upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    *host = request.Host
+  }))
+  t.Cleanup(upstream.Close)
+  return upstream, host
+}
+
+func TestForwardRequestWithOptionsHost(t *testing.T) {
+  upstream, host := newHostRecorder(t)
+  upstreamURL, _ := url.Parse(upstream.URL)
+  tests := []struct {
+    name string
+    options ForwardOptions
+    want string
+  }{
+    {"pass through", ForwardOptions{}, "client.example.com"},
+    {"rewrite", ForwardOptions{RewriteHost: true}, upstreamURL.Host},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      request := httptest.NewRequest("GET", "http://client.example.com/path", nil)
+      response, err := ForwardRequestWithOptions(request, upstream.URL, test.options)
+      if err != nil {
+        t.Fatal(err)
+      }
+      response.Body.Close()
+      if *host != test.want {
+        t.Errorf("upstream got Host %q, want %q", *host, test.want)
+      }
+    })
+  }
+}
+
+func TestForwardRequestToURLHost(t *testing.T) {
+  upstream, host := newHostRecorder(t)
+  upstreamURL, _ := url.Parse(upstream.URL)
+  request := httptest.NewRequest("GET", "http://client.example.com/path", nil)
+  response, err := ForwardRequestToURL(request, upstream.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if *host != upstreamURL.Host {
+    t.Errorf("upstream got Host %q, want %q", *host, upstreamURL.Host)
+  }
+}
+
+func TestForwardRequestWithOptionsCompressBody(t *testing.T) {
+  var encoding string
+  var received []byte
+  upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    encoding = request.Header.Get("Content-Encoding")
+    var body io.Reader = request.Body
+    if encoding == "gzip" {
+      gzipReader, err := gzip.NewReader(request.Body)
+      if err != nil {
+        http.Error(writer, err.Error(), http.StatusBadRequest)
+        return
+      }
+      body = gzipReader
+    }
+    received, _ = ioutil.ReadAll(body)
+  }))
+  defer upstream.Close()
+  tests := []struct {
+    name string
+    body []byte
+    wantEncoding string
+  }{
+    {"large body", bytes.Repeat([]byte("compress me "), 1000), "gzip"},
+    {"small body", []byte("tiny"), ""},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      request := httptest.NewRequest("POST", "/", bytes.NewReader(test.body))
+      response, err := ForwardRequestWithOptions(request, upstream.URL, ForwardOptions{CompressBody: true})
+      if err != nil {
+        t.Fatal(err)
+      }
+      response.Body.Close()
+      if response.StatusCode != http.StatusOK {
+        t.Fatalf("upstream responded with %s", response.Status)
+      }
+      if encoding != test.wantEncoding {
+        t.Errorf("Content-Encoding = %q, want %q", encoding, test.wantEncoding)
+      }
+      if !bytes.Equal(received, test.body) {
+        t.Errorf("upstream received %d bytes that don't match the %d sent", len(received), len(test.body))
+      }
+    })
+  }
+}
+
+// Returns its data, then fails as if the connection dropped.
+type failingReader struct {
+  data []byte
+}
+
+func (reader *failingReader) Read(buffer []byte) (int, error) {
+  if len(reader.data) == 0 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  n := copy(buffer, reader.data)
+  reader.data = reader.data[n:]
+  return n, nil
+}
+
+func TestSaveRequestBodyAsFilePrematureEOF(t *testing.T) {
+  tests := []struct {
+    name string
+    body io.Reader
+    options SaveBodyOptions
+    wantErr error
+  }{
+    {"read error", &failingReader{bytes.Repeat([]byte("x"), 100 << 10)}, SaveBodyOptions{}, io.ErrUnexpectedEOF},
+    {"short body", bytes.NewReader([]byte("only part")), SaveBodyOptions{VerifyLength: true}, ErrShortBody},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      dir := t.TempDir()
+      filePath := filepath.Join(dir, "upload")
+      request := httptest.NewRequest("PUT", "/", test.body)
+      request.ContentLength = 200 << 10
+      err := SaveRequestBodyAsFileWithOptions(request, filePath, test.options)
+      if !errors.Is(err, test.wantErr) {
+        t.Errorf("got error %v, want %v", err, test.wantErr)
+      }
+      entries, err := ioutil.ReadDir(dir)
+      if err != nil {
+        t.Fatal(err)
+      }
+      for _, entry := range entries {
+        t.Errorf("%s was left behind", entry.Name())
+      }
+    })
+  }
+}
+
+func TestSaveRequestBodyAsFile(t *testing.T) {
+  filePath := filepath.Join(t.TempDir(), "upload")
+  request := httptest.NewRequest("PUT", "/", bytes.NewReader([]byte("complete")))
+  err := SaveRequestBodyAsFile(request, filePath, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := os.ReadFile(filePath)
+  if err != nil || string(data) != "complete" {
+    t.Errorf("saved %q, %v", data, err)
+  }
+  request = httptest.NewRequest("PUT", "/", bytes.NewReader([]byte("again")))
+  if SaveRequestBodyAsFile(request, filePath, false) == nil {
+    t.Error("overwrote an existing file without overwrite")
+  }
+}
+
+// Results of requests sent before the breaker opened, or sent alongside the
+// probe, must not move the breaker; only the probe's result does.
+func TestCircuitBreakerIgnoresStaleResults(t *testing.T) {
+  breaker := NewCircuitBreaker(1, 0)
+  stale, ok := breaker.allow()
+  if !ok {
+    t.Fatal("a closed breaker refused a request")
+  }
+  failed, _ := breaker.allow()
+  breaker.record(failed, false)
+  // A success from before the breaker opened doesn't close it.
+  breaker.record(stale, true)
+  probe, ok := breaker.allow()
+  if !ok || !probe.probe {
+    t.Fatal("expected a probe once the cooldown passed")
+  }
+  // A late failure doesn't end the probe, so no second probe is let through.
+  breaker.record(stale, false)
+  if _, ok := breaker.allow(); ok {
+    t.Fatal("a second probe was let through while the first was in flight")
+  }
+  breaker.record(probe, true)
+  if _, ok := breaker.allow(); !ok {
+    t.Fatal("a successful probe didn't close the breaker")
+  }
+  // Nor does a late failure from the open era count against the closed breaker.
+  breaker.record(failed, false)
+  if ticket, ok := breaker.allow(); !ok || ticket.probe {
+    t.Fatal("a stale failure re-opened the breaker")
+  }
+}
+
+// An empty file has nothing to resume, so one request must finish the upload.
+func TestUploadFileChunkedEmptyFile(t *testing.T) {
+  ranges := []string{}
+  server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    ranges = append(ranges, request.Header.Get("Content-Range"))
+    writer.WriteHeader(http.StatusCreated)
+  }))
+  defer server.Close()
+  filePath := filepath.Join(t.TempDir(), "empty")
+  err := ioutil.WriteFile(filePath, nil, 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = UploadFileChunked(server.URL, filePath, 1024, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(ranges) != 1 || ranges[0] != "bytes */0" {
+    t.Errorf("Content-Range headers = %q, want [\"bytes */0\"]", ranges)
+  }
+}
+
+func TestForwardRequestWithOptionsAllowedContentTypes(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+  }))
+  defer upstream.Close()
+  tests := []struct {
+    name string
+    allowed []string
+    wantErr bool
+  }{
+    {"nil allows all", nil, false},
+    {"empty allows all", []string{}, false},
+    {"wildcard", []string{"text/*"}, false},
+    {"other type", []string{"application/json"}, true},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      request := httptest.NewRequest("GET", "http://client.example.com/path", nil)
+      response, err := ForwardRequestWithOptions(request, upstream.URL, ForwardOptions{AllowedContentTypes: test.allowed})
+      if test.wantErr {
+        if !errors.Is(err, ErrDisallowedContentType) {
+          t.Errorf("expected ErrDisallowedContentType, got %v", err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      response.Body.Close()
+    })
+  }
+}
+
+func TestUploadTokenizerBaseDirs(t *testing.T) {
+  root := string(os.PathSeparator)
+  if volume := filepath.VolumeName(os.TempDir()); volume != "" {
+    root = volume + root
+  }
+  tests := []struct {
+    name string
+    baseDir string
+  }{
+    {"root", root},
+    {"current directory", "."},
+    {"trailing separator", "base" + string(os.PathSeparator)},
+    {"relative", "base"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      tokenizer := NewUploadTokenizer([]byte("secret"), test.baseDir)
+      destPath, err := tokenizer.ResolveToken(tokenizer.IssueToken("uploads/a.txt", time.Minute))
+      if err != nil {
+        t.Fatal(err)
+      }
+      if want := filepath.Join(test.baseDir, "uploads", "a.txt"); destPath != want {
+        t.Errorf("ResolveToken() = %q, want %q", destPath, want)
+      }
+      if test.baseDir == root {
+        // Nothing can climb above the root.
+        return
+      }
+      for _, relPath := range []string{"../a.txt", "uploads/../../a.txt", "."} {
+        _, err = tokenizer.ResolveToken(tokenizer.IssueToken(relPath, time.Minute))
+        if err != ErrInvalidToken {
+          t.Errorf("a token for %q resolved: %v", relPath, err)
+        }
+      }
+    })
+  }
+}